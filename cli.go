@@ -0,0 +1,86 @@
+// cli.go - command line front-end
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const cliUsage = `usage: deputize <command> [flags]
+
+Commands:
+  run    sync on-call information once and print the result as JSON
+  serve  sync on-call information on a schedule until stopped
+
+Run "deputize <command> -h" for the flags a command takes. Started by the
+AWS Lambda runtime with no arguments, deputize runs as a Lambda handler.
+`
+
+// runCLI runs deputize from the command line, returning the exit code.
+func runCLI(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "run":
+		return cliRun(args[1:])
+	case "serve":
+		return cliServe(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "deputize: unknown command %q\n\n%s", args[0], cliUsage)
+		return 2
+	}
+}
+
+// cliRun does a single sync from a config file.
+func cliRun(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	configPath := fs.String("config", "config.json", "path to the deputize JSON config")
+	dryRun := fs.Bool("dry-run", false, "report what would change without changing it (overrides DryRun in the config)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfigFile(*configPath)
+	if err != nil {
+		log.Printf("Error: %s\n", err)
+		return 1
+	}
+	if *dryRun {
+		cfg.DryRun = true
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The result is printed even if the run failed, so it's clear how far it got
+	result, runErr := runDeputize(ctx, cfg)
+	if runErr != nil {
+		log.Printf("Error: %s\n", runErr)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		log.Printf("Error: unable to write result: %s\n", err)
+		return 1
+	}
+	if runErr != nil {
+		return 1
+	}
+	return 0
+}
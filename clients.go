@@ -0,0 +1,42 @@
+// clients.go - API clients shared across sinks and pipelines
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// httpTimeout bounds each request to the services we call with a plain
+// http.Client, so a server that never answers can't hang a run that has no
+// deadline.
+const httpTimeout = 30 * time.Second
+
+// clientCache hands out API clients for a run, so every sink talking to the
+// same service with the same credentials shares one client.
+type clientCache struct {
+	mu      sync.Mutex
+	clients map[string]any
+}
+
+func newClientCache() *clientCache {
+	return &clientCache{clients: map[string]any{}}
+}
+
+// cachedClient returns the client stored under key, calling create to make it
+// the first time it's asked for.
+func cachedClient[T any](c *clientCache, key string, create func() (T, error)) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.clients[key]; ok {
+		return client.(T), nil
+	}
+	client, err := create()
+	if err != nil {
+		return client, err
+	}
+	c.clients[key] = client
+	return client, nil
+}
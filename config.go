@@ -10,140 +10,191 @@ import (
 	"fmt"
 	"log"
 	"os"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"strings"
+	"time"
 )
 
 type deputizeConfig struct {
-	SecretPath   string
-	SecretRegion string
-	Source       deputizeSourceConfig
-	Sinks        deputizeSinkConfig
-}
-
-type deputizeSourceConfig struct {
-	PagerDuty deputizePDConfig
-}
+	DryRun        bool
+	SecretBackend string
+	SecretPath    string
+	SecretRegion  string
+	Vault         deputizeVaultConfig
+	Source        map[string]json.RawMessage
+	Sinks         map[string]json.RawMessage
+	Pipelines     []deputizePipelineConfig
+	Serve         deputizeServeConfig
+	// MaxParallelSinks is how many sinks run at once.
+	MaxParallelSinks int
+	// SinkTimeout is how long each sink gets, as a Go duration. Sinks are
+	// also cut off shortly before the Lambda deadline.
+	SinkTimeout string
+	// Identities maps on-call emails to who they are in each sink, for people
+	// whose emails differ between systems.
+	Identities map[string]deputizeIdentity
+	// IdentitiesFile is a JSON file of identities in the same format.
+	IdentitiesFile string
+	// IdentitiesSecretPath is where to find identities in the secret backend,
+	// in the same format.
+	IdentitiesSecretPath string
+	// UnresolvedUsers is what sinks do about on-call users they can't find,
+	// unless they set their own.
+	UnresolvedUsers unresolvedPolicy
 
-type deputizeSinkConfig struct {
-	Gitlab deputizeGitlabConfig
-	LDAP   deputizeLDAPConfig
-	Slack  deputizeSlackConfig
+	// filled in by validateConfig
+	sources     []namedSource
+	sinks       []namedSink
+	sinkTimeout time.Duration
 }
 
-type deputizeGitlabConfig struct {
-	ApproverSchedule string
-	Enabled          bool
-	Group            string
-	Server           string
-}
-
-type deputizeLDAPConfig struct {
-	Enabled            bool
-	BaseDN             string
-	RootCAFile         string
-	Server             string
-	Port               int
-	MailAttribute      string
-	MemberAttribute    string
-	ModUserDN          string
-	OnCallGroup        string
-	UserAttribute      string
-	InsecureSkipVerify bool
-}
+// deputizePipelineConfig binds a selection of on-call schedules to a set of
+// sinks. Pipelines run alongside the top level Sinks, sharing sources,
+// secrets and clients.
+type deputizePipelineConfig struct {
+	Name string
+	// Schedules feed the pipeline's sinks, unless a sink picks its own.
+	Schedules []string
+	Sinks     map[string]json.RawMessage
 
-type deputizePDConfig struct {
-	Enabled         bool
-	OnCallSchedules []string
-	WithOAuth       bool
-	OAuthSecretPath string
+	// filled in by validateConfig from Sinks
+	sinks []namedSink
 }
 
-type deputizeSlackConfig struct {
-	Channels    []string
-	Enabled     bool
-	PostMessage bool
-}
+// deputizeSecrets is the set of key/value pairs stored in the deputize
+// secret, keyed by names such as PDAuthToken or SlackAuthToken.
+type deputizeSecrets map[string]string
 
-type deputizeSecrets struct {
-	GitlabAuthToken     string
-	LDAPModUserPassword string
-	PDAuthToken         string
-	SlackAuthToken      string
+// loadConfigFile reads a deputize config from a JSON file, in the same format
+// as a Lambda invocation payload.
+func loadConfigFile(path string) (*deputizeConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %s", err)
+	}
+	var cfg deputizeConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s: %s", path, err)
+	}
+	return &cfg, nil
 }
 
 func validateConfig(cfg *deputizeConfig) error {
 	var configErrors []string
 
+	if cfg.SecretBackend == "" {
+		cfg.SecretBackend = secretBackendSecretsManager
+	}
+	knownBackend := false
+	for _, b := range secretBackends {
+		if strings.EqualFold(cfg.SecretBackend, b) {
+			cfg.SecretBackend = b
+			knownBackend = true
+		}
+	}
+	if !knownBackend {
+		configErrors = append(configErrors, fmt.Sprintf("SecretBackend must be one of %s", strings.Join(secretBackends, ", ")))
+	}
 	if cfg.SecretPath == "" {
-		configErrors = append(configErrors, "SecretPath not set")
+		if cfg.SecretBackend == secretBackendEnv {
+			cfg.SecretPath = "DEPUTIZE_"
+		} else {
+			configErrors = append(configErrors, "SecretPath not set")
+		}
 	}
 	if cfg.SecretRegion == "" {
 		cfg.SecretRegion = os.Getenv("AWS_REGION")
 	}
+	if cfg.SecretBackend == secretBackendVault {
+		if cfg.Vault.Address == "" {
+			cfg.Vault.Address = os.Getenv("VAULT_ADDR")
+		}
+		if cfg.Vault.Address == "" {
+			configErrors = append(configErrors, "Vault: Address not set and VAULT_ADDR is empty")
+		}
+		if cfg.Vault.Mount == "" {
+			cfg.Vault.Mount = "secret"
+		}
+		if cfg.Vault.Namespace == "" {
+			cfg.Vault.Namespace = os.Getenv("VAULT_NAMESPACE")
+		}
+	}
 
-	// Sources
-	if !cfg.Source.PagerDuty.Enabled {
-		configErrors = append(configErrors, "Source: No source enabled")
+	if cfg.MaxParallelSinks == 0 {
+		cfg.MaxParallelSinks = 4
+	}
+	if cfg.MaxParallelSinks < 0 {
+		configErrors = append(configErrors, "MaxParallelSinks is invalid")
+	}
+	if cfg.SinkTimeout == "" {
+		cfg.SinkTimeout = "2m"
+	}
+	if d, err := time.ParseDuration(cfg.SinkTimeout); err != nil || d <= 0 {
+		configErrors = append(configErrors, "SinkTimeout must be a positive duration")
+	} else {
+		cfg.sinkTimeout = d
 	}
 
-	if cfg.Source.PagerDuty.Enabled {
-		if len(cfg.Source.PagerDuty.OnCallSchedules) == 0 {
-			configErrors = append(configErrors, "Pagerduty Source: No On Call Groups Selected")
-		}
-		if cfg.Source.PagerDuty.WithOAuth {
-			if cfg.Source.PagerDuty.OAuthSecretPath == "" {
-				configErrors = append(configErrors, "Pagerduty Source: OAuth enabled, but OAuthSecretPath is not configured")
+	for _, e := range cfg.UnresolvedUsers.validate() {
+		configErrors = append(configErrors, e)
+	}
+	if cfg.UnresolvedUsers.Action == "" {
+		cfg.UnresolvedUsers.Action = unresolvedSkip
+	}
+	// Sinks without a policy of their own use the top level one
+	defaultUnresolved := func(sinks []namedSink) {
+		for i := range sinks {
+			if sinks[i].Unresolved.Action == "" {
+				sinks[i].Unresolved = cfg.UnresolvedUsers
 			}
 		}
 	}
 
-	// Sinks
-	if cfg.Sinks.Gitlab.Enabled {
-		if cfg.Sinks.Gitlab.Server == "" {
-			configErrors = append(configErrors, "Gitlab Sink: Server not configured")
-		}
-		if cfg.Sinks.Gitlab.Group == "" {
-			configErrors = append(configErrors, "Gitlab Sink: Group not configured")
-		}
-		if cfg.Sinks.Gitlab.ApproverSchedule == "" {
-			configErrors = append(configErrors, "Gitlab Sink: ApproverSchedule not configured")
-		}
+	// Sources
+	sources, errs := loadSources(cfg.Source)
+	configErrors = append(configErrors, errs...)
+	if len(sources) == 0 {
+		configErrors = append(configErrors, "Source: No source enabled")
 	}
-	if cfg.Sinks.LDAP.Enabled {
-		if cfg.Sinks.LDAP.BaseDN == "" {
-			configErrors = append(configErrors, "LDAP Sink: BaseDN not configured")
-		}
-		if cfg.Sinks.LDAP.MailAttribute == "" {
-			cfg.Sinks.LDAP.MailAttribute = "mail"
-		}
-		if cfg.Sinks.LDAP.MemberAttribute == "" {
-			cfg.Sinks.LDAP.MemberAttribute = "memberOf"
-		}
-		if cfg.Sinks.LDAP.ModUserDN == "" {
-			configErrors = append(configErrors, "LDAP Sink: ModUserDN not configured")
-		}
-		if cfg.Sinks.LDAP.OnCallGroup == "" {
-			configErrors = append(configErrors, "LDAP Sink: OnCallGroup not configured")
+	for _, src := range sources {
+		for _, e := range src.Validate() {
+			configErrors = append(configErrors, fmt.Sprintf("%s Source: %s", src.Name, e))
 		}
-		if cfg.Sinks.LDAP.Port < 1 || cfg.Sinks.LDAP.Port > 65535 {
-			configErrors = append(configErrors, "LDAP Sink: Port is invalid")
+	}
+
+	// Sinks
+	sinks, errs := loadSinks(cfg.Sinks)
+	configErrors = append(configErrors, errs...)
+	defaultUnresolved(sinks)
+	for _, sink := range sinks {
+		for _, e := range sink.Validate() {
+			configErrors = append(configErrors, fmt.Sprintf("%s Sink: %s", sink.Name, e))
 		}
-		if cfg.Sinks.LDAP.RootCAFile == "" {
-			cfg.Sinks.LDAP.RootCAFile = "truststore.pem"
+	}
+
+	// Pipelines
+	pipelineNames := map[string]bool{}
+	for i := range cfg.Pipelines {
+		p := &cfg.Pipelines[i]
+		if p.Name == "" {
+			configErrors = append(configErrors, fmt.Sprintf("Pipeline %d: Name not configured", i+1))
+		} else if pipelineNames[p.Name] {
+			configErrors = append(configErrors, fmt.Sprintf("Pipeline %s: Name used more than once", p.Name))
 		}
-		if cfg.Sinks.LDAP.Server == "" {
-			configErrors = append(configErrors, "LDAP Sink: Server not configured")
+		pipelineNames[p.Name] = true
+
+		var errs []string
+		p.sinks, errs = loadSinks(p.Sinks)
+		for _, e := range errs {
+			configErrors = append(configErrors, fmt.Sprintf("Pipeline %s: %s", p.Name, e))
 		}
-		if cfg.Sinks.LDAP.UserAttribute == "" {
-			cfg.Sinks.LDAP.UserAttribute = "uid"
+		if len(p.sinks) == 0 {
+			configErrors = append(configErrors, fmt.Sprintf("Pipeline %s: No sink enabled", p.Name))
 		}
-	}
-	if cfg.Sinks.Slack.Enabled {
-		if len(cfg.Sinks.Slack.Channels) == 0 {
-			configErrors = append(configErrors, "Slack Sink: Channels not configured")
+		defaultUnresolved(p.sinks)
+		for _, sink := range p.sinks {
+			for _, e := range sink.Validate() {
+				configErrors = append(configErrors, fmt.Sprintf("Pipeline %s: %s Sink: %s", p.Name, sink.Name, e))
+			}
 		}
 	}
 
@@ -151,58 +202,74 @@ func validateConfig(cfg *deputizeConfig) error {
 		return fmt.Errorf("config validation error(s): %s", buildErrorMsg(configErrors))
 	}
 
-	log.Printf("Config: %+v", cfg)
+	cfg.sources = sources
+	cfg.sinks = sinks
+
+	log.Printf("Config: DryRun:%t SecretBackend:%s SecretPath:%s SecretRegion:%s MaxParallelSinks:%d SinkTimeout:%s", cfg.DryRun, cfg.SecretBackend, cfg.SecretPath, cfg.SecretRegion, cfg.MaxParallelSinks, cfg.SinkTimeout)
+	for _, src := range sources {
+		log.Printf("Source %s: %+v", src.Name, src.Source)
+	}
+	for _, sink := range sinks {
+		log.Printf("Sink %s: %+v", sink.Name, sink.Sink)
+	}
+	for _, p := range cfg.Pipelines {
+		for _, sink := range p.sinks {
+			log.Printf("Pipeline %s: Schedules:%v Sink %s: %+v", p.Name, p.Schedules, sink.Name, sink.Sink)
+		}
+	}
 	return nil
 }
 
-func buildSecrets(c *deputizeConfig) (deputizeSecrets, error) {
+// buildSecrets reads the deputize secret and any secrets the modules need,
+// returning them along with the provider they came from.
+func buildSecrets(ctx context.Context, c *deputizeConfig) (deputizeSecrets, SecretProvider, error) {
 	var configErrors []string
 
-	svcCfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(c.SecretRegion))
+	provider, err := newSecretProvider(ctx, c)
 	if err != nil {
-		return deputizeSecrets{}, fmt.Errorf("could not initialize aws svc cfg: %s", err)
-	}
-	svc := secretsmanager.NewFromConfig(svcCfg)
-	input := &secretsmanager.GetSecretValueInput{
-		SecretId: aws.String(c.SecretPath),
+		return deputizeSecrets{}, nil, err
 	}
-	result, err := svc.GetSecretValue(context.TODO(), input)
+	sec, err := provider.Secrets(ctx, c.SecretPath)
 	if err != nil {
-		return deputizeSecrets{}, fmt.Errorf("could not get secret: %s", err)
+		return deputizeSecrets{}, nil, err
 	}
 
-	var sec deputizeSecrets
-	json.Unmarshal([]byte(*result.SecretString), &sec)
-
-	if c.Source.PagerDuty.Enabled && !c.Source.PagerDuty.WithOAuth && sec.PDAuthToken == "" {
-		configErrors = append(configErrors, "PagerDuty source is enabled, but there's an empty or nonexistant value for PDAuthToken in AWS Secrets Manager")
-	}
-	if c.Source.PagerDuty.Enabled && c.Source.PagerDuty.WithOAuth {
-		input := &secretsmanager.GetSecretValueInput{
-			SecretId: aws.String(c.Source.PagerDuty.OAuthSecretPath),
+	checkSecrets := func(kind string, name string, module any, keys []string) error {
+		if loader, ok := module.(secretLoader); ok {
+			if err := loader.LoadSecrets(ctx, provider, sec); err != nil {
+				return err
+			}
 		}
-		result, err := svc.GetSecretValue(context.TODO(), input)
-		if err != nil {
-			return deputizeSecrets{}, fmt.Errorf("could not get PD OAuth secret: %s", err)
+		for _, key := range keys {
+			if sec[key] == "" {
+				configErrors = append(configErrors, fmt.Sprintf("%s %s is enabled, but there's an empty or nonexistant %s value in the %s secret backend", name, kind, key, c.SecretBackend))
+			}
 		}
-		sec.PDAuthToken = *result.SecretString
+		return nil
 	}
-
-	if c.Sinks.Gitlab.Enabled && sec.GitlabAuthToken == "" {
-		configErrors = append(configErrors, "Gitlab sink is enabled, but there's an empty or nonexistant GitlabAuthToken value in AWS Secrets Manager")
+	for _, src := range c.sources {
+		if err := checkSecrets("source", src.Name, src.Source, src.Secrets()); err != nil {
+			return deputizeSecrets{}, nil, err
+		}
 	}
-	if c.Sinks.LDAP.Enabled && sec.LDAPModUserPassword == "" {
-		configErrors = append(configErrors, "LDAP sink is enabled, but there's an empty or nonexistant LDAPModUserPassword value in AWS Secrets Manager")
+	for _, sink := range c.sinks {
+		if err := checkSecrets("sink", sink.Name, sink.Sink, sink.Secrets()); err != nil {
+			return deputizeSecrets{}, nil, err
+		}
 	}
-	if c.Sinks.Slack.Enabled && sec.SlackAuthToken == "" {
-		configErrors = append(configErrors, "Slack sink is enabled, but there's an empty or nonexistant SlackAuthToken value in AWS Secrets Manager")
+	for _, p := range c.Pipelines {
+		for _, sink := range p.sinks {
+			if err := checkSecrets("sink", fmt.Sprintf("Pipeline %s: %s", p.Name, sink.Name), sink.Sink, sink.Secrets()); err != nil {
+				return deputizeSecrets{}, nil, err
+			}
+		}
 	}
 
 	if len(configErrors) > 0 {
-		return deputizeSecrets{}, fmt.Errorf(buildErrorMsg(configErrors))
+		return deputizeSecrets{}, nil, fmt.Errorf(buildErrorMsg(configErrors))
 	}
 
-	return sec, nil
+	return sec, provider, nil
 }
 
 func buildErrorMsg(errs []string) string {
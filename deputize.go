@@ -6,62 +6,265 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 )
 
 func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+	// The Lambda runtime starts us without arguments; anything else is the CLI.
+	if len(os.Args) > 1 || !inLambda() {
+		os.Exit(runCLI(os.Args[1:]))
+	}
 	lambda.Start(runLambda)
 }
 
-func runLambda(ctx context.Context, cfg *deputizeConfig) (string, error) {
+// inLambda reports whether we were started by a Lambda runtime, using the same
+// variables lambda.Start does: AWS_LAMBDA_RUNTIME_API for the runtime API, and
+// _LAMBDA_SERVER_PORT for the RPC mode of the go1.x runtime.
+func inLambda() bool {
+	return os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" || os.Getenv("_LAMBDA_SERVER_PORT") != ""
+}
 
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+// runLambda is the AWS Lambda handler; the config is the invocation payload.
+func runLambda(ctx context.Context, cfg *deputizeConfig) (*deputizeResult, error) {
+	return runDeputize(ctx, cfg)
+}
 
-	err := validateConfig(cfg)
+// runDeputize reads who is on call from the configured sources and pushes it
+// to the configured sinks. It's shared by every way of running deputize. The
+// result is filled in as far as the run got, even when it returns an error.
+func runDeputize(ctx context.Context, cfg *deputizeConfig) (*deputizeResult, error) {
+	result := &deputizeResult{DryRun: cfg.DryRun, Started: time.Now()}
+	err := syncOnCall(ctx, cfg, result)
 	if err != nil {
-		return "", err
+		// Keep any source errors already recorded
+		if result.Error != "" {
+			result.Error += "; "
+		}
+		result.Error += err.Error()
 	}
+	result.DurationMs = time.Since(result.Started).Milliseconds()
+	return result, err
+}
 
-	sec, err := buildSecrets(cfg)
+func syncOnCall(ctx context.Context, cfg *deputizeConfig, result *deputizeResult) error {
+	err := validateConfig(cfg)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	oncallEmails, err := getPagerdutyInfo(ctx, cfg.Source.PagerDuty.WithOAuth, sec.PDAuthToken, cfg.Source.PagerDuty.OnCallSchedules)
+	sec, provider, err := buildSecrets(ctx, cfg)
 	if err != nil {
-		return "", err
+		return err
+	}
+	identities, err := loadIdentities(ctx, cfg, provider)
+	if err != nil {
+		return err
+	}
+
+	resolver := newOnCallResolver(cfg.sources, sec)
+	defer func() { result.Sources = resolver.sourceResults() }()
+	// A schedule that can't be looked up doesn't stop the run. Sinks that
+	// need it fail when they ask for it, under their own Critical flag, and
+	// the rest carry on.
+	oncallEmails, sourceErrors := resolver.resolveEach(ctx, nil, onCallWindow{})
+	result.OnCall = oncallEmails
+	if len(sourceErrors) > 0 {
+		log.Printf("Warning: source error(s): %s\n", buildErrorMsg(sourceErrors))
+		result.Error = fmt.Sprintf("source error(s): %s", buildErrorMsg(sourceErrors))
 	}
 
 	log.Printf("Current On-Call Users: %s\n", strings.Join(oncallEmails, ", "))
 
-	if cfg.Sinks.LDAP.Enabled {
-		err := updateLDAP(cfg.Sinks.LDAP, oncallEmails, sec.LDAPModUserPassword)
-		if err != nil {
-			return "", err
+	if cfg.DryRun {
+		log.Printf("Dry run enabled, sinks will not be modified\n")
+	}
+
+	run := &sinkRun{
+		sec:        sec,
+		lookup:     resolver.resolve,
+		oncallAt:   resolver.onCallAt,
+		shifts:     resolver.shifts,
+		schedules:  resolver.scheduleNames,
+		incidents:  resolver.openIncidents,
+		dryRun:     cfg.DryRun,
+		clients:    newClientCache(),
+		identities: identities,
+	}
+
+	// Every sink gets a go, even if an earlier one failed
+	jobs := sinkJobs(run, "", cfg.sinks)
+	for _, p := range cfg.Pipelines {
+		pipelineRun := *run
+		pipelineRun.lookup = pipelineLookup(run.lookup, p.Schedules)
+		pipelineRun.oncallAt = pipelinePast(run.oncallAt, p.Schedules)
+		pipelineRun.shifts = pipelineShifts(run.shifts, p.Schedules)
+		pipelineRun.schedules = pipelineScheduleNames(run.schedules, p.Schedules)
+		jobs = append(jobs, sinkJobs(&pipelineRun, p.Name, p.sinks)...)
+	}
+	sinkErrors := runSinks(ctx, jobs, cfg.MaxParallelSinks, cfg.sinkTimeout, result)
+
+	if len(sinkErrors) > 0 {
+		return fmt.Errorf("sink error(s): %s", buildErrorMsg(sinkErrors))
+	}
+	return nil
+}
+
+// sinkDeadlineMargin is how long before the caller's deadline (such as the
+// Lambda timeout) sinks are cut off, leaving time to report the result.
+const sinkDeadlineMargin = 5 * time.Second
+
+// sinkJob is a sink waiting to be run.
+type sinkJob struct {
+	pipeline string
+	sink     namedSink
+	run      *sinkRun
+}
+
+func sinkJobs(run *sinkRun, pipeline string, sinks []namedSink) []sinkJob {
+	var jobs []sinkJob
+	for _, sink := range sinks {
+		thisRun := *run
+		thisRun.unresolvedPolicy = sink.Unresolved
+		thisRun.window = sink.Window
+		jobs = append(jobs, sinkJob{pipeline: pipeline, sink: sink, run: &thisRun})
+	}
+	return jobs
+}
+
+// runSinks runs the sinks, up to parallel at once, each with its own timeout,
+// recording how each went in result. It returns the errors from critical
+// sinks that failed; failures of other sinks are logged and recorded, but
+// don't fail the run.
+func runSinks(ctx context.Context, jobs []sinkJob, parallel int, timeout time.Duration, result *deputizeResult) []string {
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-sinkDeadlineMargin))
+		defer cancel()
+	}
+
+	results := make([]sinkResult, len(jobs))
+	errs := make([]error, len(jobs))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i], errs[i] = runSink(ctx, job, timeout)
+		}()
+	}
+	wg.Wait()
+
+	var sinkErrors []string
+	for i, job := range jobs {
+		result.Sinks = append(result.Sinks, results[i])
+		result.Unresolved = removeDuplicates(append(result.Unresolved, results[i].Unresolved...))
+		if errs[i] != nil && job.sink.Critical {
+			name := job.sink.Name
+			if job.pipeline != "" {
+				name = fmt.Sprintf("pipeline %s: %s", job.pipeline, job.sink.Name)
+			}
+			sinkErrors = append(sinkErrors, fmt.Sprintf("%s sink: %s", name, errs[i]))
 		}
 	}
+	return sinkErrors
+}
+
+// runSink runs a single sink with a timeout.
+func runSink(ctx context.Context, job sinkJob, timeout time.Duration) (sinkResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	name := job.sink.Name
+	if job.pipeline != "" {
+		name = fmt.Sprintf("pipeline %s: %s", job.pipeline, job.sink.Name)
+	}
+	log.Printf("Running %s sink\n", name)
+
+	start := time.Now()
+	changes, err := job.sink.Update(ctx, job.run)
+	res := sinkResult{
+		Pipeline:   job.pipeline,
+		Sink:       job.sink.Name,
+		Critical:   job.sink.Critical,
+		Status:     sinkUnchanged,
+		Changes:    changes,
+		Unresolved: removeDuplicates(job.run.unresolved),
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	switch {
+	case err != nil:
+		res.Status = sinkFailed
+		res.Error = err.Error()
+		log.Printf("Error: %s sink failed: %s\n", name, err)
+	case len(changes) > 0 && job.run.dryRun:
+		res.Status = sinkPlanned
+	case len(changes) > 0:
+		res.Status = sinkUpdated
+	}
+	return res, err
+}
 
-	if cfg.Sinks.Gitlab.Enabled {
-		gitlabApprovers, err := getPagerdutyInfo(ctx, cfg.Source.PagerDuty.WithOAuth, sec.PDAuthToken, []string{cfg.Sinks.Gitlab.ApproverSchedule})
-		if err != nil {
-			return "", err
+// pipelineLookup hands sinks that don't pick their own schedules the
+// pipeline's schedules instead of every schedule.
+func pipelineLookup(oncall onCallLookup, schedules []string) onCallLookup {
+	if len(schedules) == 0 {
+		return oncall
+	}
+	return func(ctx context.Context, sinkSchedules []string, window onCallWindow) ([]string, error) {
+		if len(sinkSchedules) == 0 {
+			sinkSchedules = schedules
 		}
-		log.Printf("Gitlab Approvers: %s\n", strings.Join(gitlabApprovers, ", "))
-		err = updateGitlab(cfg.Sinks.Gitlab, gitlabApprovers, sec.GitlabAuthToken)
-		if err != nil {
-			return "", err
+		return oncall(ctx, sinkSchedules, window)
+	}
+}
+
+// pipelinePast is pipelineLookup for who was on call in the past.
+func pipelinePast(oncallAt pastLookup, schedules []string) pastLookup {
+	if len(schedules) == 0 {
+		return oncallAt
+	}
+	return func(ctx context.Context, sinkSchedules []string, at time.Time) ([]string, error) {
+		if len(sinkSchedules) == 0 {
+			sinkSchedules = schedules
 		}
+		return oncallAt(ctx, sinkSchedules, at)
 	}
+}
 
-	if cfg.Sinks.Slack.Enabled {
-		err := updateSlack(cfg.Sinks.Slack, oncallEmails, sec.SlackAuthToken)
-		if err != nil {
-			return "", err
+// pipelineShifts is pipelineLookup for upcoming shifts.
+func pipelineShifts(shifts shiftLookup, schedules []string) shiftLookup {
+	if len(schedules) == 0 {
+		return shifts
+	}
+	return func(ctx context.Context, sinkSchedules []string, from time.Time, until time.Time) ([]onCallShift, error) {
+		if len(sinkSchedules) == 0 {
+			sinkSchedules = schedules
 		}
+		return shifts(ctx, sinkSchedules, from, until)
 	}
+}
 
-	return strings.Join(oncallEmails, ", "), nil
+// pipelineScheduleNames is pipelineLookup for schedule names.
+func pipelineScheduleNames(names func([]string) ([]string, error), schedules []string) func([]string) ([]string, error) {
+	if len(schedules) == 0 {
+		return names
+	}
+	return func(sinkSchedules []string) ([]string, error) {
+		if len(sinkSchedules) == 0 {
+			sinkSchedules = schedules
+		}
+		return names(sinkSchedules)
+	}
 }
@@ -0,0 +1,231 @@
+// deputize_test.go - tests for running the sinks
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink is a Sink that reports a fixed outcome.
+type fakeSink struct {
+	changes    []sinkChange
+	err        error
+	unresolved []string
+}
+
+func (s *fakeSink) Validate() []string { return nil }
+func (s *fakeSink) Secrets() []string  { return nil }
+
+func (s *fakeSink) Update(ctx context.Context, run *sinkRun) ([]sinkChange, error) {
+	for _, email := range s.unresolved {
+		run.unresolvedUser(email)
+	}
+	return s.changes, s.err
+}
+
+func TestPipelineLookup(t *testing.T) {
+	// echo hands back the schedules it was asked about
+	echo := func(ctx context.Context, schedules []string, window onCallWindow) ([]string, error) {
+		return schedules, nil
+	}
+	tests := []struct {
+		name              string
+		pipelineSchedules []string
+		sinkSchedules     []string
+		want              []string
+	}{
+		{"neither", nil, nil, nil},
+		{"pipeline", []string{"Ops"}, nil, []string{"Ops"}},
+		{"sink", nil, []string{"DBA"}, []string{"DBA"}},
+		{"sink overrides pipeline", []string{"Ops"}, []string{"DBA"}, []string{"DBA"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pipelineLookup(echo, tt.pipelineSchedules)(context.Background(), tt.sinkSchedules, onCallWindow{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lookup asked about %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunSinksStatus(t *testing.T) {
+	changed := []sinkChange{{Target: "oncall", Add: []string{"alice"}}}
+	tests := []struct {
+		name       string
+		sink       *fakeSink
+		dryRun     bool
+		status     string
+		unresolved []string
+		wantErr    bool
+	}{
+		{"unchanged", &fakeSink{}, false, sinkUnchanged, nil, false},
+		{"updated", &fakeSink{changes: changed}, false, sinkUpdated, nil, false},
+		{"planned", &fakeSink{changes: changed}, true, sinkPlanned, nil, false},
+		{"failed", &fakeSink{err: errors.New("boom")}, false, sinkFailed, nil, true},
+		{"unresolved", &fakeSink{unresolved: []string{"bob@example.com", "bob@example.com"}}, false, sinkUnchanged, []string{"bob@example.com"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &deputizeResult{}
+			run := &sinkRun{dryRun: tt.dryRun}
+			jobs := sinkJobs(run, "Ops", []namedSink{{Name: "Fake", Critical: true, Sink: tt.sink}})
+			errs := runSinks(context.Background(), jobs, 1, time.Minute, result)
+			if (len(errs) > 0) != tt.wantErr {
+				t.Fatalf("errs = %q, wantErr %v", errs, tt.wantErr)
+			}
+			if len(result.Sinks) != 1 {
+				t.Fatalf("got %d sink results, want 1", len(result.Sinks))
+			}
+			res := result.Sinks[0]
+			if res.Status != tt.status || res.Pipeline != "Ops" || res.Sink != "Fake" {
+				t.Errorf("result %+v, want status %s for pipeline Ops sink Fake", res, tt.status)
+			}
+			if len(res.Unresolved) != len(tt.unresolved) || len(tt.unresolved) > 0 && !reflect.DeepEqual(res.Unresolved, tt.unresolved) {
+				t.Errorf("Unresolved = %q, want %q", res.Unresolved, tt.unresolved)
+			}
+			if tt.wantErr && res.Error == "" {
+				t.Errorf("Error not recorded")
+			}
+		})
+	}
+}
+
+func TestRunSinksContinuesAfterFailure(t *testing.T) {
+	failing := &fakeSink{err: errors.New("boom")}
+	working := &fakeSink{changes: []sinkChange{{Target: "oncall", Add: []string{"alice"}}}}
+	sinks := []namedSink{
+		{Name: "First", Critical: true, Sink: failing},
+		{Name: "Optional", Critical: false, Sink: failing},
+		{Name: "Last", Critical: true, Sink: working},
+	}
+	result := &deputizeResult{}
+	errs := runSinks(context.Background(), sinkJobs(&sinkRun{}, "", sinks), 1, time.Minute, result)
+	if want := []string{"First sink: boom"}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("errs = %q, want only the critical failure %q", errs, want)
+	}
+	var statuses []string
+	for _, res := range result.Sinks {
+		statuses = append(statuses, res.Sink+" "+res.Status)
+	}
+	if want := []string{"First failed", "Optional failed", "Last updated"}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("statuses = %q, want %q", statuses, want)
+	}
+}
+
+// slowSink is a Sink that takes a while, tracking how many copies of it run
+// at once.
+type slowSink struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	running int
+	most    int
+}
+
+func (s *slowSink) Validate() []string { return nil }
+func (s *slowSink) Secrets() []string  { return nil }
+
+func (s *slowSink) Update(ctx context.Context, run *sinkRun) ([]sinkChange, error) {
+	s.mu.Lock()
+	s.running++
+	s.most = max(s.most, s.running)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running--
+		s.mu.Unlock()
+	}()
+	select {
+	case <-time.After(s.delay):
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestRunSinksParallel(t *testing.T) {
+	sink := &slowSink{delay: 20 * time.Millisecond}
+	var sinks []namedSink
+	for _, name := range []string{"A", "B", "C", "D", "E", "F"} {
+		sinks = append(sinks, namedSink{Name: name, Critical: true, Sink: sink})
+	}
+	result := &deputizeResult{}
+	if errs := runSinks(context.Background(), sinkJobs(&sinkRun{}, "", sinks), 2, time.Minute, result); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if sink.most != 2 {
+		t.Errorf("%d sinks ran at once, want 2", sink.most)
+	}
+	// Results are reported in config order, however the sinks finished
+	for i, res := range result.Sinks {
+		if res.Sink != sinks[i].Name {
+			t.Errorf("result %d is for sink %s, want %s", i, res.Sink, sinks[i].Name)
+		}
+	}
+}
+
+func TestRunSinksTimeout(t *testing.T) {
+	sinks := []namedSink{
+		{Name: "Slow", Critical: true, Sink: &slowSink{delay: time.Minute}},
+		{Name: "Fast", Critical: true, Sink: &slowSink{}},
+	}
+	result := &deputizeResult{}
+	errs := runSinks(context.Background(), sinkJobs(&sinkRun{}, "", sinks), 2, 20*time.Millisecond, result)
+	if len(errs) != 1 {
+		t.Errorf("errs = %q, want just the slow sink", errs)
+	}
+	if result.Sinks[0].Status != sinkFailed || result.Sinks[1].Status != sinkUnchanged {
+		t.Errorf("statuses %s, %s, want the slow sink to time out", result.Sinks[0].Status, result.Sinks[1].Status)
+	}
+}
+
+func TestRunSinksDeadlineMargin(t *testing.T) {
+	// The caller's deadline leaves no time once the margin is taken off, so
+	// the sink is cut off straight away rather than after its timeout
+	ctx, cancel := context.WithTimeout(context.Background(), sinkDeadlineMargin)
+	defer cancel()
+	result := &deputizeResult{}
+	start := time.Now()
+	runSinks(ctx, sinkJobs(&sinkRun{}, "", []namedSink{{Name: "Slow", Sink: &slowSink{delay: time.Minute}}}), 1, time.Minute, result)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("sink ran for %s, past the deadline margin", elapsed)
+	}
+	if result.Sinks[0].Status != sinkFailed {
+		t.Errorf("status %s, want %s", result.Sinks[0].Status, sinkFailed)
+	}
+}
+
+func TestPipelineScheduleNames(t *testing.T) {
+	echo := func(schedules []string) ([]string, error) {
+		return schedules, nil
+	}
+	if got, _ := pipelineScheduleNames(echo, []string{"Ops"})(nil); !reflect.DeepEqual(got, []string{"Ops"}) {
+		t.Errorf("names asked about %q, want the pipeline's schedules", got)
+	}
+	if got, _ := pipelineScheduleNames(echo, []string{"Ops"})([]string{"DBA"}); !reflect.DeepEqual(got, []string{"DBA"}) {
+		t.Errorf("names asked about %q, want the sink's schedules", got)
+	}
+}
+
+func TestPipelinePast(t *testing.T) {
+	echo := func(ctx context.Context, schedules []string, at time.Time) ([]string, error) {
+		return schedules, nil
+	}
+	if got, _ := pipelinePast(echo, []string{"Ops"})(context.Background(), nil, time.Now()); !reflect.DeepEqual(got, []string{"Ops"}) {
+		t.Errorf("lookup asked about %q, want the pipeline's schedules", got)
+	}
+	if got, _ := pipelinePast(echo, []string{"Ops"})(context.Background(), []string{"DBA"}, time.Now()); !reflect.DeepEqual(got, []string{"DBA"}) {
+		t.Errorf("lookup asked about %q, want the sink's schedules", got)
+	}
+}
@@ -8,6 +8,8 @@ require (
 	github.com/aws/aws-sdk-go-v2 v1.36.3
 	github.com/aws/aws-sdk-go-v2/config v1.29.14
 	github.com/aws/aws-sdk-go-v2/service/secretsmanager v1.35.4
+	github.com/aws/aws-sdk-go-v2/service/ssm v1.59.1
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/slack-go/slack v0.16.0
 	gitlab.com/gitlab-org/api/client-go v0.128.0
 	gopkg.in/ldap.v2 v2.5.1
@@ -4,6 +4,8 @@
 
 package main
 
+import "strings"
+
 func contains(str []string, search string) bool {
 	for _, a := range str {
 		if a == search {
@@ -31,3 +33,32 @@ func removeDuplicates(elements []string) []string {
 	// Return the new slice.
 	return result
 }
+
+// difference returns the elements of a that aren't in b.
+func difference(a []string, b []string) []string {
+	var diff []string
+	for _, v := range a {
+		if !contains(b, v) {
+			diff = append(diff, v)
+		}
+	}
+	return diff
+}
+
+// differenceFold returns the elements of a that aren't in b, ignoring case.
+func differenceFold(a []string, b []string) []string {
+	var diff []string
+	for _, v := range a {
+		found := false
+		for _, w := range b {
+			if strings.EqualFold(v, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diff = append(diff, v)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,54 @@
+// helpers_test.go - tests for the helpers
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRemoveDuplicates(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{"empty", nil, []string{}},
+		{"no duplicates", []string{"a", "b"}, []string{"a", "b"}},
+		{"keeps first", []string{"b", "a", "b", "c", "a"}, []string{"b", "a", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := removeDuplicates(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("removeDuplicates() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDifference(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want []string
+		fold []string
+	}{
+		{"empty", nil, nil, nil, nil},
+		{"nothing removed", []string{"a", "b"}, nil, []string{"a", "b"}, []string{"a", "b"}},
+		{"some removed", []string{"a", "b", "c"}, []string{"b"}, []string{"a", "c"}, []string{"a", "c"}},
+		{"case", []string{"A", "b"}, []string{"a"}, []string{"A", "b"}, []string{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := difference(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("difference() = %q, want %q", got, tt.want)
+			}
+			if got := differenceFold(tt.a, tt.b); !reflect.DeepEqual(got, tt.fold) {
+				t.Errorf("differenceFold() = %q, want %q", got, tt.fold)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+// identity.go - mapping on-call users to their identities in each sink
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// deputizeIdentity is who an on-call user is in each of the sinks, for people
+// whose on-call email doesn't match the one the sink knows them by. Empty
+// fields fall back to looking the user up by email.
+type deputizeIdentity struct {
+	// LDAP is the value of the LDAP sink's UserAttribute, e.g. the uid.
+	LDAP string
+	// GitLab is the GitLab username.
+	GitLab string
+	// Slack is the Slack user ID, e.g. U0123ABCD.
+	Slack string
+	// GitHub is the GitHub login.
+	GitHub string
+}
+
+// identityMap maps on-call emails, lowercased, to identities.
+type identityMap map[string]deputizeIdentity
+
+// lookup returns the identity mapped to email, if any.
+func (m identityMap) lookup(email string) deputizeIdentity {
+	return m[strings.ToLower(email)]
+}
+
+// loadIdentities builds the identity mapping for a run. Mappings come from
+// IdentitiesFile, then IdentitiesSecretPath, then the inline Identities, with
+// later ones overriding earlier ones for the same email.
+func loadIdentities(ctx context.Context, cfg *deputizeConfig, provider SecretProvider) (identityMap, error) {
+	identities := identityMap{}
+	merge := func(src string, data []byte) error {
+		var m map[string]deputizeIdentity
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("unable to parse identities from %s: %s", src, err)
+		}
+		for email, id := range m {
+			identities[strings.ToLower(email)] = id
+		}
+		return nil
+	}
+
+	if cfg.IdentitiesFile != "" {
+		data, err := os.ReadFile(cfg.IdentitiesFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read identities file: %s", err)
+		}
+		if err := merge(cfg.IdentitiesFile, data); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.IdentitiesSecretPath != "" {
+		value, err := provider.Secret(ctx, cfg.IdentitiesSecretPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not get identities secret: %s", err)
+		}
+		if err := merge(cfg.IdentitiesSecretPath, []byte(value)); err != nil {
+			return nil, err
+		}
+	}
+	for email, id := range cfg.Identities {
+		identities[strings.ToLower(email)] = id
+	}
+	return identities, nil
+}
+
+// Actions for an unresolvedPolicy.
+const (
+	unresolvedSkip     = "Skip"
+	unresolvedFail     = "Fail"
+	unresolvedFallback = "Fallback"
+)
+
+var unresolvedActions = []string{unresolvedSkip, unresolvedFail, unresolvedFallback}
+
+// unresolvedPolicy is what a sink does with an on-call user it can't find.
+type unresolvedPolicy struct {
+	// Action is Skip (the default) to leave the user out with a warning, Fail
+	// to fail the sink, or Fallback to use the Fallback users instead.
+	Action string
+	// Fallback users stand in for anyone who can't be found. They're given as
+	// the sink knows them: LDAP uids, GitLab usernames, Slack user IDs or
+	// GitHub logins. Slack also takes user group IDs, standing in the group's
+	// members.
+	Fallback []string
+}
+
+// validate checks the policy, normalising the case of Action. An empty Action
+// is left for the caller to default.
+func (p *unresolvedPolicy) validate() []string {
+	var configErrors []string
+	if p.Action != "" {
+		action := ""
+		for _, a := range unresolvedActions {
+			if strings.EqualFold(p.Action, a) {
+				action = a
+			}
+		}
+		if action == "" {
+			configErrors = append(configErrors, fmt.Sprintf("UnresolvedUsers: unknown Action %s, expected one of %s", p.Action, strings.Join(unresolvedActions, ", ")))
+		}
+		p.Action = action
+	}
+	if p.Action == unresolvedFallback && len(p.Fallback) == 0 {
+		configErrors = append(configErrors, "UnresolvedUsers: Action is Fallback, but no Fallback users configured")
+	}
+	return configErrors
+}
@@ -0,0 +1,137 @@
+// identity_test.go - tests for identity mapping
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeSecretProvider serves secrets from a map.
+type fakeSecretProvider map[string]string
+
+func (p fakeSecretProvider) Secrets(ctx context.Context, path string) (deputizeSecrets, error) {
+	return nil, fmt.Errorf("no secrets at %s", path)
+}
+
+func (p fakeSecretProvider) Secret(ctx context.Context, path string) (string, error) {
+	value, ok := p[path]
+	if !ok {
+		return "", fmt.Errorf("no secret at %s", path)
+	}
+	return value, nil
+}
+
+func TestIdentityMapLookup(t *testing.T) {
+	m := identityMap{"alice@example.com": {Slack: "U0ALICE"}}
+	if got := m.lookup("Alice@Example.com").Slack; got != "U0ALICE" {
+		t.Errorf("lookup() Slack = %q, want U0ALICE", got)
+	}
+	if got := m.lookup("bob@example.com"); got != (deputizeIdentity{}) {
+		t.Errorf("lookup() = %+v, want empty identity", got)
+	}
+}
+
+func TestLoadIdentities(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "identities.json")
+	err := os.WriteFile(file, []byte(`{
+		"alice@example.com": {"LDAP": "alice-file"},
+		"bob@example.com": {"LDAP": "bob-file"},
+		"carol@example.com": {"LDAP": "carol-file"}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := fakeSecretProvider{
+		"deputize/identities": `{"Bob@Example.com": {"LDAP": "bob-secret"}, "carol@example.com": {"LDAP": "carol-secret"}}`,
+		"deputize/broken":     `not json`,
+	}
+
+	tests := []struct {
+		name    string
+		cfg     deputizeConfig
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "none",
+			cfg:  deputizeConfig{},
+			want: map[string]string{},
+		},
+		{
+			name: "later sources override earlier ones",
+			cfg: deputizeConfig{
+				IdentitiesFile:       file,
+				IdentitiesSecretPath: "deputize/identities",
+				Identities:           map[string]deputizeIdentity{"CAROL@example.com": {LDAP: "carol-inline"}},
+			},
+			want: map[string]string{"alice@example.com": "alice-file", "bob@example.com": "bob-secret", "carol@example.com": "carol-inline"},
+		},
+		{
+			name:    "missing file",
+			cfg:     deputizeConfig{IdentitiesFile: filepath.Join(t.TempDir(), "nope.json")},
+			wantErr: true,
+		},
+		{
+			name:    "missing secret",
+			cfg:     deputizeConfig{IdentitiesSecretPath: "deputize/nope"},
+			wantErr: true,
+		},
+		{
+			name:    "bad json",
+			cfg:     deputizeConfig{IdentitiesSecretPath: "deputize/broken"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identities, err := loadIdentities(context.Background(), &tt.cfg, provider)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := map[string]string{}
+			for email, id := range identities {
+				got[email] = id.LDAP
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("identities = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnresolvedPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy unresolvedPolicy
+		action string
+		errs   int
+	}{
+		{"empty", unresolvedPolicy{}, "", 0},
+		{"skip", unresolvedPolicy{Action: "Skip"}, unresolvedSkip, 0},
+		{"case", unresolvedPolicy{Action: "fail"}, unresolvedFail, 0},
+		{"fallback", unresolvedPolicy{Action: "Fallback", Fallback: []string{"U0ONCALL1"}}, unresolvedFallback, 0},
+		{"fallback without users", unresolvedPolicy{Action: "Fallback"}, unresolvedFallback, 1},
+		{"unknown", unresolvedPolicy{Action: "Ignore"}, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.policy.validate()
+			if len(errs) != tt.errs {
+				t.Errorf("validate() = %q, want %d errors", errs, tt.errs)
+			}
+			if tt.policy.Action != tt.action {
+				t.Errorf("Action = %q, want %q", tt.policy.Action, tt.action)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+// mod_github.go - GitHub sink code
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+type deputizeGitHubConfig struct {
+	Enabled bool
+	// Server is the URL of a GitHub Enterprise Server instance, e.g.
+	// https://github.example.com/. Leave it empty for github.com.
+	Server string
+	Org    string
+	// Schedules feed the team. Leave empty to use every source schedule.
+	Schedules []string
+	// Team is the slug of the team to keep in sync, e.g. oncall for @org/oncall.
+	Team string
+	// Users maps on-call emails to GitHub logins.
+	//
+	// Deprecated: use the GitHub field of the top level Identities instead,
+	// which take precedence over Users.
+	Users map[string]string
+}
+
+func init() {
+	registerSink("GitHub", func() Sink { return &deputizeGitHubConfig{} })
+}
+
+func (cfg *deputizeGitHubConfig) Validate() []string {
+	var configErrors []string
+	if cfg.Org == "" {
+		configErrors = append(configErrors, "Org not configured")
+	}
+	if cfg.Team == "" {
+		configErrors = append(configErrors, "Team not configured")
+	}
+	if len(cfg.Users) > 0 {
+		log.Printf("Warning: the GitHub sink's Users option is deprecated, move its entries to Identities\n")
+	}
+	if cfg.Server != "" && !strings.HasSuffix(cfg.Server, "/") {
+		cfg.Server = cfg.Server + "/"
+	}
+	return configErrors
+}
+
+func (cfg *deputizeGitHubConfig) Secrets() []string {
+	return []string{"GitHubAuthToken"}
+}
+
+func (cfg *deputizeGitHubConfig) Update(ctx context.Context, run *sinkRun) ([]sinkChange, error) {
+	oncallEmails, err := run.oncall(ctx, cfg.Schedules)
+	if err != nil {
+		return nil, err
+	}
+	token := run.sec["GitHubAuthToken"]
+	client, _ := cachedClient(run.clients, "github\x00"+cfg.Server+"\x00"+token, func() (*githubClient, error) {
+		return newGitHubClient(cfg.Server, token), nil
+	})
+	return updateGitHub(ctx, *cfg, oncallEmails, client, run)
+}
+
+func updateGitHub(ctx context.Context, cfg deputizeGitHubConfig, pdOnCallEmails []string, client *githubClient, run *sinkRun) ([]sinkChange, error) {
+	log.Printf("Beginning GitHub Update.\n")
+	team := fmt.Sprintf("%s/%s", cfg.Org, cfg.Team)
+
+	// Resolve on-call emails to logins: the identity mapping first, then the
+	// deprecated Users, then verified org emails
+	userMap := map[string]string{}
+	for email, login := range cfg.Users {
+		userMap[strings.ToLower(email)] = login
+	}
+	var orgEmails map[string]string
+	var newOnCallLogins []string
+	for _, email := range pdOnCallEmails {
+		login := run.identities.lookup(email).GitHub
+		ok := login != ""
+		if !ok {
+			login, ok = userMap[strings.ToLower(email)]
+		}
+		if ok {
+			// Mappings can name anyone, and adding someone who isn't in the
+			// org to a team would invite them to it
+			member, err := client.isOrgMember(ctx, cfg.Org, login)
+			if err != nil {
+				return nil, fmt.Errorf("unable to check org membership of %s: %s", login, err)
+			}
+			if !member {
+				log.Printf("GitHub user %s for email %s is not a member of org %s\n", login, email, cfg.Org)
+				ok = false
+			}
+		} else {
+			if orgEmails == nil {
+				var err error
+				orgEmails, err = client.orgVerifiedEmails(ctx, cfg.Org)
+				if err != nil {
+					return nil, fmt.Errorf("unable to get verified emails for org %s: %s", cfg.Org, err)
+				}
+			}
+			login, ok = orgEmails[strings.ToLower(email)]
+			if !ok {
+				log.Printf("No GitHub user found for email %s\n", email)
+			}
+		}
+		if !ok {
+			fallback, err := run.unresolvedUser(email)
+			if err != nil {
+				return nil, err
+			}
+			for _, login := range fallback {
+				member, err := client.isOrgMember(ctx, cfg.Org, login)
+				if err != nil {
+					return nil, fmt.Errorf("unable to check org membership of %s: %s", login, err)
+				}
+				if !member {
+					return nil, fmt.Errorf("fallback user %s is not a member of org %s", login, cfg.Org)
+				}
+			}
+			newOnCallLogins = append(newOnCallLogins, fallback...)
+			continue
+		}
+		log.Printf("User found! login is %s for email %s\n", login, email)
+		newOnCallLogins = append(newOnCallLogins, login)
+	}
+	newOnCallLogins = removeDuplicates(newOnCallLogins)
+
+	if len(newOnCallLogins) == 0 {
+		// If no users are in the new list, leave the team alone
+		log.Printf("No on-call users found, not updating GitHub team: %s", team)
+		log.Printf("GitHub Update Complete.\n")
+		return nil, nil
+	}
+
+	// Maintainers are left alone, but we need to know about them so we don't
+	// demote them by adding them as members.
+	allMembers, err := client.teamMembers(ctx, cfg.Org, cfg.Team, "all")
+	if err != nil {
+		return nil, fmt.Errorf("github could not get team members: %s", err)
+	}
+	members, err := client.teamMembers(ctx, cfg.Org, cfg.Team, "member")
+	if err != nil {
+		return nil, fmt.Errorf("github could not get team members: %s", err)
+	}
+
+	addLogins := differenceFold(newOnCallLogins, allMembers)
+	removeLogins := differenceFold(members, newOnCallLogins)
+	if len(addLogins) == 0 && len(removeLogins) == 0 {
+		log.Printf("GitHub team %s already up to date.\n", team)
+		log.Printf("GitHub Update Complete.\n")
+		return nil, nil
+	}
+
+	change := sinkChange{Target: team, Add: addLogins, Remove: removeLogins}
+	if run.dryRun {
+		log.Printf("Dry run, not updating GitHub team: %s\n", team)
+		return []sinkChange{change}, nil
+	}
+
+	// Add new members first so the team is never left empty
+	for _, login := range addLogins {
+		log.Printf("Adding user %s", login)
+		if err := client.setTeamMembership(ctx, cfg.Org, cfg.Team, login, true); err != nil {
+			return nil, fmt.Errorf("github could not add team member: %s", err)
+		}
+	}
+	for _, login := range removeLogins {
+		log.Printf("Removing user %s", login)
+		if err := client.setTeamMembership(ctx, cfg.Org, cfg.Team, login, false); err != nil {
+			return nil, fmt.Errorf("github could not remove team member: %s", err)
+		}
+	}
+
+	log.Printf("GitHub Update Complete.\n")
+	return []sinkChange{change}, nil
+}
+
+// githubClient is just enough of the GitHub REST and GraphQL APIs for
+// managing team membership.
+type githubClient struct {
+	restURL    string
+	graphqlURL string
+	token      string
+	client     *http.Client
+}
+
+func newGitHubClient(server string, token string) *githubClient {
+	c := &githubClient{
+		restURL:    "https://api.github.com/",
+		graphqlURL: "https://api.github.com/graphql",
+		token:      token,
+		client:     &http.Client{Timeout: httpTimeout},
+	}
+	if server != "" {
+		// GitHub Enterprise Server
+		c.restURL = server + "api/v3/"
+		c.graphqlURL = server + "api/graphql"
+	}
+	return c
+}
+
+// githubError is an error response from the GitHub API.
+type githubError struct {
+	StatusCode int
+	msg        string
+}
+
+func (e *githubError) Error() string {
+	return e.msg
+}
+
+var githubNextLinkRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// do makes a request to the GitHub API, decoding the response into out if
+// it's not nil. It returns the URL of the next page of results, if any.
+func (c *githubClient) do(ctx context.Context, method string, endpoint string, in any, out any) (string, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return "", err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", &githubError{StatusCode: resp.StatusCode, msg: fmt.Sprintf("%s %s: %s: %s", method, endpoint, resp.Status, respBody)}
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return "", fmt.Errorf("unable to parse json: %s", err)
+		}
+	}
+	var next string
+	if m := githubNextLinkRegexp.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+		next = m[1]
+	}
+	return next, nil
+}
+
+// teamMembers returns the logins of a team's members with the given role
+// (member, maintainer or all).
+func (c *githubClient) teamMembers(ctx context.Context, org string, team string, role string) ([]string, error) {
+	var logins []string
+	endpoint := fmt.Sprintf("%sorgs/%s/teams/%s/members?role=%s&per_page=100", c.restURL, url.PathEscape(org), url.PathEscape(team), role)
+	for endpoint != "" {
+		var page []struct {
+			Login string `json:"login"`
+		}
+		next, err := c.do(ctx, "GET", endpoint, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range page {
+			logins = append(logins, m.Login)
+		}
+		endpoint = next
+	}
+	return logins, nil
+}
+
+// isOrgMember reports whether login is a member of org.
+func (c *githubClient) isOrgMember(ctx context.Context, org string, login string) (bool, error) {
+	endpoint := fmt.Sprintf("%sorgs/%s/members/%s", c.restURL, url.PathEscape(org), url.PathEscape(login))
+	_, err := c.do(ctx, "GET", endpoint, nil, nil)
+	var ghErr *githubError
+	if errors.As(err, &ghErr) && ghErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// setTeamMembership adds login to the team as a member, or removes them.
+func (c *githubClient) setTeamMembership(ctx context.Context, org string, team string, login string, member bool) error {
+	endpoint := fmt.Sprintf("%sorgs/%s/teams/%s/memberships/%s", c.restURL, url.PathEscape(org), url.PathEscape(team), url.PathEscape(login))
+	if member {
+		_, err := c.do(ctx, "PUT", endpoint, map[string]string{"role": "member"}, nil)
+		return err
+	}
+	_, err := c.do(ctx, "DELETE", endpoint, nil, nil)
+	return err
+}
+
+const githubVerifiedEmailsQuery = `query($org: String!, $cursor: String) {
+  organization(login: $org) {
+    membersWithRole(first: 100, after: $cursor) {
+      pageInfo { hasNextPage endCursor }
+      nodes { login organizationVerifiedDomainEmails(login: $org) }
+    }
+  }
+}`
+
+// orgVerifiedEmails maps the verified domain emails of every org member to
+// their login. Emails are lowercased.
+func (c *githubClient) orgVerifiedEmails(ctx context.Context, org string) (map[string]string, error) {
+	emails := map[string]string{}
+	var cursor *string
+	for {
+		query := map[string]any{
+			"query":     githubVerifiedEmailsQuery,
+			"variables": map[string]any{"org": org, "cursor": cursor},
+		}
+		var resp struct {
+			Data struct {
+				Organization struct {
+					MembersWithRole struct {
+						PageInfo struct {
+							HasNextPage bool   `json:"hasNextPage"`
+							EndCursor   string `json:"endCursor"`
+						} `json:"pageInfo"`
+						Nodes []struct {
+							Login                            string   `json:"login"`
+							OrganizationVerifiedDomainEmails []string `json:"organizationVerifiedDomainEmails"`
+						} `json:"nodes"`
+					} `json:"membersWithRole"`
+				} `json:"organization"`
+			} `json:"data"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		if _, err := c.do(ctx, "POST", c.graphqlURL, query, &resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Errors) > 0 {
+			return nil, fmt.Errorf("graphql error: %s", resp.Errors[0].Message)
+		}
+		members := resp.Data.Organization.MembersWithRole
+		for _, node := range members.Nodes {
+			for _, email := range node.OrganizationVerifiedDomainEmails {
+				emails[strings.ToLower(email)] = node.Login
+			}
+		}
+		if !members.PageInfo.HasNextPage {
+			break
+		}
+		cursor = &members.PageInfo.EndCursor
+	}
+	return emails, nil
+}
@@ -0,0 +1,187 @@
+// mod_github_test.go - tests for the GitHub sink
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGitHub is just enough of a GitHub Enterprise Server for the GitHub
+// sink: one org with one team.
+type fakeGitHub struct {
+	mu sync.Mutex
+	// emails maps org members' verified emails to their logins
+	emails map[string]string
+	// members are org members without a verified email
+	members []string
+	// team maps team members' logins to their role
+	team map[string]string
+	// requests made that change the team
+	changes []string
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.URL.Path == "/api/graphql":
+		var nodes []map[string]any
+		for email, login := range f.emails {
+			nodes = append(nodes, map[string]any{"login": login, "organizationVerifiedDomainEmails": []string{email}})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"organization": map[string]any{"membersWithRole": map[string]any{
+			"pageInfo": map[string]any{"hasNextPage": false},
+			"nodes":    nodes,
+		}}}})
+	case strings.HasPrefix(r.URL.Path, "/api/v3/orgs/acme/members/"):
+		login := strings.TrimPrefix(r.URL.Path, "/api/v3/orgs/acme/members/")
+		for _, l := range f.emails {
+			if l == login {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		for _, l := range f.members {
+			if l == login {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	case r.URL.Path == "/api/v3/orgs/acme/teams/oncall/members":
+		role := r.URL.Query().Get("role")
+		var members []map[string]string
+		for login, r := range f.team {
+			if role == "all" || role == r {
+				members = append(members, map[string]string{"login": login})
+			}
+		}
+		json.NewEncoder(w).Encode(members)
+	case strings.HasPrefix(r.URL.Path, "/api/v3/orgs/acme/teams/oncall/memberships/"):
+		login := strings.TrimPrefix(r.URL.Path, "/api/v3/orgs/acme/teams/oncall/memberships/")
+		f.changes = append(f.changes, r.Method+" "+login)
+		if r.Method == "DELETE" {
+			delete(f.team, login)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		f.team[login] = "member"
+		fmt.Fprint(w, `{"state": "active"}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestUpdateGitHub(t *testing.T) {
+	tests := []struct {
+		name    string
+		emails  []string
+		dryRun  bool
+		policy  unresolvedPolicy
+		wantErr bool
+		add     []string
+		remove  []string
+		changes []string
+	}{
+		{
+			name:    "handoff",
+			emails:  []string{"carol@example.com", "Dave@Example.com"},
+			add:     []string{"carol", "dave-gh"},
+			remove:  []string{"alice"},
+			changes: []string{"DELETE alice", "PUT carol", "PUT dave-gh"},
+		},
+		{
+			name:   "dry run",
+			emails: []string{"carol@example.com"},
+			dryRun: true,
+			add:    []string{"carol"},
+			remove: []string{"alice"},
+		},
+		{
+			name:   "maintainers are left alone",
+			emails: []string{"alice@example.com", "mallory@example.com"},
+		},
+		{
+			name:    "identity mapping",
+			emails:  []string{"alice@example.com", "erin@example.com"},
+			add:     []string{"erin-gh"},
+			changes: []string{"PUT erin-gh"},
+		},
+		{
+			name:   "mapped user not in the org",
+			emails: []string{"alice@example.com", "frank@example.com"},
+		},
+		{
+			name:    "fallback for mapped user not in the org",
+			emails:  []string{"alice@example.com", "frank@example.com"},
+			policy:  unresolvedPolicy{Action: unresolvedFallback, Fallback: []string{"carol"}},
+			add:     []string{"carol"},
+			changes: []string{"PUT carol"},
+		},
+		{
+			name:    "fallback not in the org",
+			emails:  []string{"alice@example.com", "nobody@example.com"},
+			policy:  unresolvedPolicy{Action: unresolvedFallback, Fallback: []string{"outsider"}},
+			wantErr: true,
+		},
+		{
+			name:   "nobody found",
+			emails: []string{"nobody@example.com"},
+		},
+		{
+			name:    "fallback for nobody found",
+			emails:  []string{"alice@example.com", "nobody@example.com"},
+			policy:  unresolvedPolicy{Action: unresolvedFallback, Fallback: []string{"carol"}},
+			add:     []string{"carol"},
+			changes: []string{"PUT carol"},
+		},
+		{
+			name:    "fail for nobody found",
+			emails:  []string{"alice@example.com", "nobody@example.com"},
+			policy:  unresolvedPolicy{Action: unresolvedFail},
+			wantErr: true,
+		},
+	}
+	identities := identityMap{"erin@example.com": {GitHub: "erin-gh"}, "frank@example.com": {GitHub: "frank-gh"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gh := &fakeGitHub{
+				emails:  map[string]string{"alice@example.com": "alice", "carol@example.com": "carol", "mallory@example.com": "mallory"},
+				members: []string{"dave-gh", "erin-gh"},
+				team:    map[string]string{"alice": "member", "mallory": "maintainer"},
+			}
+			srv := httptest.NewServer(gh)
+			defer srv.Close()
+
+			cfg := deputizeGitHubConfig{Server: srv.URL + "/", Org: "acme", Team: "oncall", Users: map[string]string{"dave@example.com": "dave-gh"}}
+			changes, err := updateGitHub(context.Background(), cfg, tt.emails, newGitHubClient(cfg.Server, "token"), &sinkRun{dryRun: tt.dryRun, identities: identities, unresolvedPolicy: tt.policy})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			var add, remove []string
+			for _, c := range changes {
+				add = append(add, c.Add...)
+				remove = append(remove, c.Remove...)
+			}
+			sort.Strings(add)
+			if !reflect.DeepEqual(add, tt.add) || !reflect.DeepEqual(remove, tt.remove) {
+				t.Errorf("changes add %q remove %q, want add %q remove %q", add, remove, tt.add, tt.remove)
+			}
+			sort.Strings(gh.changes)
+			if !reflect.DeepEqual(gh.changes, tt.changes) {
+				t.Errorf("requests %q, want %q", gh.changes, tt.changes)
+			}
+		})
+	}
+}
@@ -5,85 +5,222 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strings"
 
 	"gitlab.com/gitlab-org/api/client-go"
 )
 
-func updateGitlab(cfg deputizeGitlabConfig, pdOnCallEmails []string, gitlabAuthToken string) error {
-	log.Printf("Beginning Gitlab Update.\n")
-	var newOnCallApproverGitlabUserIDs []int
+type deputizeGitlabConfig struct {
+	ApproverSchedule string
+	Enabled          bool
+	Group            string
+	// Schedules feed the approver group, along with ApproverSchedule. Leave
+	// both empty to use every source schedule.
+	Schedules []string
+	Server    string
+}
+
+func init() {
+	registerSink("Gitlab", func() Sink { return &deputizeGitlabConfig{} })
+}
 
-	client, err := gitlab.NewClient(gitlabAuthToken, gitlab.WithBaseURL(cfg.Server+"api/v4"))
+func (cfg *deputizeGitlabConfig) Validate() []string {
+	var configErrors []string
+	if cfg.Server == "" {
+		configErrors = append(configErrors, "Server not configured")
+	}
+	if cfg.Group == "" {
+		configErrors = append(configErrors, "Group not configured")
+	}
+	if cfg.ApproverSchedule != "" && !contains(cfg.Schedules, cfg.ApproverSchedule) {
+		cfg.Schedules = append(cfg.Schedules, cfg.ApproverSchedule)
+	}
+	return configErrors
+}
+
+func (cfg *deputizeGitlabConfig) Secrets() []string {
+	return []string{"GitlabAuthToken"}
+}
+
+func (cfg *deputizeGitlabConfig) Update(ctx context.Context, run *sinkRun) ([]sinkChange, error) {
+	approverEmails, err := run.oncall(ctx, cfg.Schedules)
 	if err != nil {
-		return fmt.Errorf("could not initialize client: %s", err)
+		return nil, err
 	}
+	log.Printf("Gitlab Approvers: %s\n", strings.Join(approverEmails, ", "))
+	token := run.sec["GitlabAuthToken"]
+	client, err := cachedClient(run.clients, "gitlab\x00"+cfg.Server+"\x00"+token, func() (*gitlab.Client, error) {
+		return gitlab.NewClient(token, gitlab.WithBaseURL(cfg.Server+"api/v4"))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize client: %s", err)
+	}
+	return updateGitlab(ctx, *cfg, approverEmails, client, run)
+}
+
+func updateGitlab(ctx context.Context, cfg deputizeGitlabConfig, pdOnCallEmails []string, client *gitlab.Client, run *sinkRun) ([]sinkChange, error) {
+	log.Printf("Beginning Gitlab Update.\n")
+	var newOnCallApproverGitlabUsers []*gitlab.User
+
 	// Lets get user ids for On Call people
 	for _, email := range pdOnCallEmails {
 		userOptions := &gitlab.ListUsersOptions{Search: gitlab.Ptr(email)}
-		users, _, err := client.Users.ListUsers(userOptions)
+		if username := run.identities.lookup(email).GitLab; username != "" {
+			userOptions = &gitlab.ListUsersOptions{Username: gitlab.Ptr(username)}
+		}
+		users, _, err := client.Users.ListUsers(userOptions, gitlab.WithContext(ctx))
 		if err != nil {
-			log.Printf("Warning: Got %s back from Gitlab API\n", err)
+			// Don't mistake an API failure for a missing user
+			return nil, fmt.Errorf("unable to look up gitlab user for %s: %s", email, err)
 		}
 		if len(users) == 1 {
 			// We expect only one user returned based on an email. We error out otherwise
 			log.Printf("User found! username is %s for email %s\n", users[0].Username, email)
-			newOnCallApproverGitlabUserIDs = append(newOnCallApproverGitlabUserIDs, users[0].ID)
+			newOnCallApproverGitlabUsers = append(newOnCallApproverGitlabUsers, users[0])
 		} else if len(users) == 0 {
 			log.Printf("No user found for email %s\n", email)
+			fallback, err := run.unresolvedUser(email)
+			if err != nil {
+				return nil, err
+			}
+			for _, username := range fallback {
+				users, _, err := client.Users.ListUsers(&gitlab.ListUsersOptions{Username: gitlab.Ptr(username)}, gitlab.WithContext(ctx))
+				if err != nil {
+					return nil, fmt.Errorf("unable to look up gitlab fallback user %s: %s", username, err)
+				}
+				if len(users) != 1 {
+					return nil, fmt.Errorf("unable to find fallback user %s", username)
+				}
+				newOnCallApproverGitlabUsers = append(newOnCallApproverGitlabUsers, users[0])
+			}
 		} else {
 			// Lets output some helpful information if we don't get 1 user
 			for _, user := range users {
 				log.Printf("Found the following users associated with \"%s\": %s\n", email, user.Username)
 			}
-			return fmt.Errorf("found more than one user with an email of %s: %d users found", email, len(users))
+			return nil, fmt.Errorf("found more than one user with an email of %s: %d users found", email, len(users))
 		}
 	}
 
-	if len(newOnCallApproverGitlabUserIDs) == 0 {
+	// Fallback users may stand in for more than one person
+	seen := map[int]bool{}
+	var uniqueUsers []*gitlab.User
+	for _, user := range newOnCallApproverGitlabUsers {
+		if !seen[user.ID] {
+			seen[user.ID] = true
+			uniqueUsers = append(uniqueUsers, user)
+		}
+	}
+	newOnCallApproverGitlabUsers = uniqueUsers
+
+	if len(newOnCallApproverGitlabUsers) == 0 {
 		// If no users are in the new approver list, leave the group alone
 		log.Printf("No new Approvers, not updating Gitlab group: %s", cfg.Group)
-	} else {
-		// Add OnCall approvers to approver group
-		log.Printf("Updating Gitlab group: %s", cfg.Group)
+		log.Printf("Gitlab Update Complete.\n")
+		return nil, nil
+	}
 
-		// Remove existing members of the group, if they exist
-		log.Printf("Removing old approvers from Gitlab group: %s", cfg.Group)
+	// Get the existing members of the group
+	var approverGroupMembers []*gitlab.GroupMember
+	listOpts := &gitlab.ListGroupMembersOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		members, resp, err := client.Groups.ListGroupMembers(cfg.Group, listOpts, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("gitlab could not get group members: %s", err.Error())
+		}
+		approverGroupMembers = append(approverGroupMembers, members...)
+		if resp.NextPage == 0 {
+			break
+		}
+		listOpts.Page = resp.NextPage
+	}
+
+	// Work out who needs to go and who needs to be added, leaving everyone
+	// else's membership alone.
+	newApproverIDs := map[int]bool{}
+	for _, user := range newOnCallApproverGitlabUsers {
+		newApproverIDs[user.ID] = true
+	}
+	currentMemberIDs := map[int]bool{}
+	var removeMembers []*gitlab.GroupMember
+	// On-call members as a Guest or Reporter can't approve, so they're
+	// raised to Developer like new members
+	var promoteMembers []*gitlab.GroupMember
+	for _, member := range approverGroupMembers {
+		currentMemberIDs[member.ID] = true
+		// Don't remove group owner/maintainers
+		if member.AccessLevel < 40 && !newApproverIDs[member.ID] {
+			removeMembers = append(removeMembers, member)
+		}
+		if member.AccessLevel < gitlab.DeveloperPermissions && newApproverIDs[member.ID] {
+			promoteMembers = append(promoteMembers, member)
+		}
+	}
+	var addUsers []*gitlab.User
+	for _, user := range newOnCallApproverGitlabUsers {
+		if !currentMemberIDs[user.ID] {
+			addUsers = append(addUsers, user)
+		}
+	}
+
+	if len(removeMembers) == 0 && len(addUsers) == 0 && len(promoteMembers) == 0 {
+		log.Printf("Gitlab group %s already up to date.\n", cfg.Group)
+		log.Printf("Gitlab Update Complete.\n")
+		return nil, nil
+	}
+
+	change := sinkChange{Target: cfg.Group}
+	for _, member := range removeMembers {
+		change.Remove = append(change.Remove, member.Username)
+	}
+	for _, user := range addUsers {
+		change.Add = append(change.Add, user.Username)
+	}
+	for _, member := range promoteMembers {
+		change.Add = append(change.Add, member.Username)
+	}
+	if run.dryRun {
+		log.Printf("Dry run, not updating Gitlab group: %s\n", cfg.Group)
+		return []sinkChange{change}, nil
+	}
 
-		// Get the existing members of the group
-		approverGroupMembers, _, err := client.Groups.ListGroupMembers(cfg.Group, &gitlab.ListGroupMembersOptions{})
+	log.Printf("Updating Gitlab group: %s", cfg.Group)
+
+	// Add new members first so the group is never left without approvers
+	for _, newApprover := range addUsers {
+		log.Printf("Adding user %s", newApprover.Username)
+		addGroupMemberOpts := &gitlab.AddGroupMemberOptions{
+			UserID:      gitlab.Ptr(newApprover.ID),
+			AccessLevel: gitlab.Ptr(gitlab.DeveloperPermissions),
+		}
+		_, _, err := client.GroupMembers.AddGroupMember(cfg.Group, addGroupMemberOpts, gitlab.WithContext(ctx))
 		if err != nil {
-			return fmt.Errorf("gitlab could not get group members: %s", err.Error())
+			return nil, fmt.Errorf("gitlab could not add group member: %s", err)
 		}
-		if len(approverGroupMembers) > 0 {
-			// Remove existing members
-			for _, member := range approverGroupMembers {
-				// Don't remove group owner/maintainers
-				if member.AccessLevel < 40 {
-					log.Printf("Removing user %s", member.Username)
-					_, err := client.GroupMembers.RemoveGroupMember(cfg.Group, member.ID, &gitlab.RemoveGroupMemberOptions{})
-					if err != nil {
-						return fmt.Errorf("gitlab could not remove group member: %s", err)
-					}
-				}
-			}
+	}
+
+	for _, member := range promoteMembers {
+		log.Printf("Raising user %s to Developer", member.Username)
+		editGroupMemberOpts := &gitlab.EditGroupMemberOptions{
+			AccessLevel: gitlab.Ptr(gitlab.DeveloperPermissions),
+		}
+		_, _, err := client.GroupMembers.EditGroupMember(cfg.Group, member.ID, editGroupMemberOpts, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("gitlab could not edit group member: %s", err)
 		}
+	}
 
-		// Add new members to the group
-		log.Printf("Adding new approvers to Gitlab group: %s", cfg.Group)
-		for _, newApproverUserID := range newOnCallApproverGitlabUserIDs {
-			log.Printf("Adding user id %d", newApproverUserID)
-			addGroupMemberOpts := &gitlab.AddGroupMemberOptions{
-				UserID:      gitlab.Ptr(newApproverUserID),
-				AccessLevel: gitlab.Ptr(gitlab.DeveloperPermissions),
-			}
-			_, _, err := client.GroupMembers.AddGroupMember(cfg.Group, addGroupMemberOpts)
-			if err != nil {
-				return fmt.Errorf("gitlab could not add group member: %s", err)
-			}
+	for _, member := range removeMembers {
+		log.Printf("Removing user %s", member.Username)
+		_, err := client.GroupMembers.RemoveGroupMember(cfg.Group, member.ID, &gitlab.RemoveGroupMemberOptions{}, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("gitlab could not remove group member: %s", err)
 		}
 	}
+
 	log.Printf("Gitlab Update Complete.\n")
-	return nil
+	return []sinkChange{change}, nil
 }
@@ -0,0 +1,161 @@
+// mod_gitlab_test.go - tests for the Gitlab sink
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"gitlab.com/gitlab-org/api/client-go"
+)
+
+// fakeGitlab is just enough of a GitLab server for the Gitlab sink: some
+// users and one group.
+type fakeGitlab struct {
+	mu sync.Mutex
+	// users by email
+	users map[string]*gitlab.User
+	// members maps group members' user IDs to their access level
+	members map[int]gitlab.AccessLevelValue
+	// requests made that change the group
+	changes []string
+}
+
+func (f *fakeGitlab) user(id int) *gitlab.User {
+	for _, u := range f.users {
+		if u.ID == id {
+			return u
+		}
+	}
+	return nil
+}
+
+func (f *fakeGitlab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.URL.Path == "/api/v4/users":
+		var users []*gitlab.User
+		for email, u := range f.users {
+			if email == r.URL.Query().Get("search") || u.Username == r.URL.Query().Get("username") {
+				users = append(users, u)
+			}
+		}
+		json.NewEncoder(w).Encode(users)
+	case r.URL.Path == "/api/v4/groups/approvers/members" && r.Method == "GET":
+		var members []*gitlab.GroupMember
+		for id, level := range f.members {
+			u := f.user(id)
+			members = append(members, &gitlab.GroupMember{ID: id, Username: u.Username, AccessLevel: level})
+		}
+		json.NewEncoder(w).Encode(members)
+	case r.URL.Path == "/api/v4/groups/approvers/members" && r.Method == "POST":
+		var opts gitlab.AddGroupMemberOptions
+		json.NewDecoder(r.Body).Decode(&opts)
+		f.members[*opts.UserID] = *opts.AccessLevel
+		f.changes = append(f.changes, fmt.Sprintf("add %s %d", f.user(*opts.UserID).Username, *opts.AccessLevel))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{}`)
+	case strings.HasPrefix(r.URL.Path, "/api/v4/groups/approvers/members/"):
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/v4/groups/approvers/members/"))
+		if r.Method == "DELETE" {
+			delete(f.members, id)
+			f.changes = append(f.changes, "remove "+f.user(id).Username)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var opts gitlab.EditGroupMemberOptions
+		json.NewDecoder(r.Body).Decode(&opts)
+		f.members[id] = *opts.AccessLevel
+		f.changes = append(f.changes, fmt.Sprintf("edit %s %d", f.user(id).Username, *opts.AccessLevel))
+		fmt.Fprint(w, `{}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestUpdateGitlab(t *testing.T) {
+	tests := []struct {
+		name    string
+		members map[int]gitlab.AccessLevelValue
+		emails  []string
+		dryRun  bool
+		add     []string
+		remove  []string
+		changes []string
+	}{
+		{
+			name:    "up to date",
+			members: map[int]gitlab.AccessLevelValue{1: gitlab.DeveloperPermissions, 3: gitlab.MaintainerPermissions},
+			emails:  []string{"alice@example.com"},
+		},
+		{
+			name:    "handoff",
+			members: map[int]gitlab.AccessLevelValue{1: gitlab.DeveloperPermissions, 3: gitlab.MaintainerPermissions},
+			emails:  []string{"bob@example.com"},
+			add:     []string{"bob"},
+			remove:  []string{"alice"},
+			changes: []string{"add bob 30", "remove alice"},
+		},
+		{
+			name:    "on-call reporter raised to developer",
+			members: map[int]gitlab.AccessLevelValue{1: gitlab.ReporterPermissions, 2: gitlab.GuestPermissions},
+			emails:  []string{"alice@example.com"},
+			add:     []string{"alice"},
+			remove:  []string{"bob"},
+			changes: []string{"edit alice 30", "remove bob"},
+		},
+		{
+			name:    "dry run",
+			members: map[int]gitlab.AccessLevelValue{1: gitlab.GuestPermissions},
+			emails:  []string{"alice@example.com"},
+			dryRun:  true,
+			add:     []string{"alice"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeGitlab{
+				users: map[string]*gitlab.User{
+					"alice@example.com": {ID: 1, Username: "alice"},
+					"bob@example.com":   {ID: 2, Username: "bob"},
+					"carol@example.com": {ID: 3, Username: "carol"},
+				},
+				members: tt.members,
+			}
+			srv := httptest.NewServer(f)
+			defer srv.Close()
+			client, err := gitlab.NewClient("token", gitlab.WithBaseURL(srv.URL+"/api/v4"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := deputizeGitlabConfig{Group: "approvers"}
+
+			changes, err := updateGitlab(context.Background(), cfg, tt.emails, client, &sinkRun{dryRun: tt.dryRun})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var add, remove []string
+			for _, c := range changes {
+				add = append(add, c.Add...)
+				remove = append(remove, c.Remove...)
+			}
+			if !reflect.DeepEqual(add, tt.add) || !reflect.DeepEqual(remove, tt.remove) {
+				t.Errorf("add %q remove %q, want %q %q", add, remove, tt.add, tt.remove)
+			}
+			if !reflect.DeepEqual(f.changes, tt.changes) {
+				t.Errorf("requests %q, want %q", f.changes, tt.changes)
+			}
+		})
+	}
+}
@@ -5,87 +5,407 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"net"
 	"os"
-	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"log"
 
 	"gopkg.in/ldap.v2"
 )
 
-func updateLDAP(cfg deputizeLDAPConfig, pdOnCallEmails []string, ldappw string) error {
+type deputizeLDAPConfig struct {
+	Enabled bool
+	// Directory is the kind of server: OpenLDAP (the default) or
+	// ActiveDirectory, which changes the defaults of the other options.
+	Directory  string
+	BaseDN     string
+	RootCAFile string
+	Server     string
+	Port       int
+	// TLSMode is StartTLS (the default) to upgrade a plain connection, or
+	// LDAPS for TLS from the start, usually on port 636.
+	TLSMode       string
+	MailAttribute string
+	// MailAttributes are tried together when finding users by email,
+	// overriding MailAttribute, e.g. mail and userPrincipalName.
+	MailAttributes  []string
+	MemberAttribute string
+	// MemberValueType is what MemberAttribute holds: "uid" for the value of
+	// UserAttribute (memberUid style groups, the default), or "dn" for the
+	// user's DN (groupOfNames, groupOfUniqueNames and Active Directory).
+	MemberValueType string
+	// ModUserDN is who we bind as. Active Directory also takes a UPN
+	// (deputize@example.com) or down-level name (EXAMPLE\deputize).
+	ModUserDN string
+	// OnCallGroup is a filter matching the group to keep in sync, such as
+	// cn=oncall. Use Groups for more than one.
+	OnCallGroup string
+	// Groups are the groups to keep in sync, each with its own schedules.
+	Groups []ldapGroup
+	// Schedules feed the on-call groups. Leave empty to use every source
+	// schedule.
+	Schedules []string
+	// UserAttribute identifies users, e.g. uid or sAMAccountName. Identity
+	// mappings and fallback users are given as its value.
+	UserAttribute      string
+	InsecureSkipVerify bool
+}
+
+// ldapGroup is a group kept in sync with who's on call. MemberAttribute,
+// MemberValueType and Schedules default to the sink's.
+type ldapGroup struct {
+	// OnCallGroup is a filter matching the group, such as cn=oncall-primary.
+	OnCallGroup string
+	// DN of the group, instead of OnCallGroup.
+	DN              string
+	MemberAttribute string
+	MemberValueType string
+	Schedules       []string
+}
+
+// Values for Directory.
+const (
+	ldapDirectoryOpenLDAP        = "OpenLDAP"
+	ldapDirectoryActiveDirectory = "ActiveDirectory"
+)
+
+// Values for TLSMode.
+const (
+	ldapTLSStartTLS = "StartTLS"
+	ldapTLSLDAPS    = "LDAPS"
+)
+
+// Values for MemberValueType.
+const (
+	ldapMemberUID = "uid"
+	ldapMemberDN  = "dn"
+)
+
+func init() {
+	registerSink("LDAP", func() Sink { return &deputizeLDAPConfig{} })
+}
+
+func (cfg *deputizeLDAPConfig) Validate() []string {
+	var configErrors []string
+	switch {
+	case cfg.Directory == "" || strings.EqualFold(cfg.Directory, ldapDirectoryOpenLDAP):
+		cfg.Directory = ldapDirectoryOpenLDAP
+	case strings.EqualFold(cfg.Directory, ldapDirectoryActiveDirectory):
+		cfg.Directory = ldapDirectoryActiveDirectory
+		if cfg.TLSMode == "" {
+			cfg.TLSMode = ldapTLSLDAPS
+		}
+		if len(cfg.MailAttributes) == 0 && cfg.MailAttribute == "" {
+			cfg.MailAttributes = []string{"mail", "userPrincipalName"}
+		}
+		if cfg.MemberAttribute == "" {
+			cfg.MemberAttribute = "member"
+		}
+		if cfg.MemberValueType == "" {
+			cfg.MemberValueType = ldapMemberDN
+		}
+		if cfg.UserAttribute == "" {
+			cfg.UserAttribute = "sAMAccountName"
+		}
+	default:
+		configErrors = append(configErrors, "Directory must be OpenLDAP or ActiveDirectory")
+	}
+	switch {
+	case cfg.TLSMode == "" || strings.EqualFold(cfg.TLSMode, ldapTLSStartTLS):
+		cfg.TLSMode = ldapTLSStartTLS
+	case strings.EqualFold(cfg.TLSMode, ldapTLSLDAPS):
+		cfg.TLSMode = ldapTLSLDAPS
+	default:
+		configErrors = append(configErrors, "TLSMode must be StartTLS or LDAPS")
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 389
+		if cfg.TLSMode == ldapTLSLDAPS {
+			cfg.Port = 636
+		}
+	}
+	if cfg.BaseDN == "" {
+		configErrors = append(configErrors, "BaseDN not configured")
+	}
+	if cfg.MailAttribute == "" {
+		cfg.MailAttribute = "mail"
+	}
+	if len(cfg.MailAttributes) == 0 {
+		cfg.MailAttributes = []string{cfg.MailAttribute}
+	}
+	if cfg.MemberAttribute == "" {
+		cfg.MemberAttribute = "memberOf"
+	}
+	switch strings.ToLower(cfg.MemberValueType) {
+	case "", ldapMemberUID:
+		cfg.MemberValueType = ldapMemberUID
+	case ldapMemberDN:
+		cfg.MemberValueType = ldapMemberDN
+	default:
+		configErrors = append(configErrors, "MemberValueType must be uid or dn")
+	}
+	if cfg.ModUserDN == "" {
+		configErrors = append(configErrors, "ModUserDN not configured")
+	}
+	switch {
+	case cfg.OnCallGroup != "" && len(cfg.Groups) > 0:
+		configErrors = append(configErrors, "only one of OnCallGroup or Groups can be configured")
+	case cfg.OnCallGroup != "":
+		// Moved into Groups, so validating again (as serve does each run)
+		// doesn't find both set
+		cfg.Groups = []ldapGroup{{OnCallGroup: cfg.OnCallGroup}}
+		cfg.OnCallGroup = ""
+	case len(cfg.Groups) == 0:
+		configErrors = append(configErrors, "neither OnCallGroup nor Groups configured")
+	}
+	for i := range cfg.Groups {
+		g := &cfg.Groups[i]
+		if g.OnCallGroup == "" && g.DN == "" {
+			configErrors = append(configErrors, fmt.Sprintf("Groups %d: neither OnCallGroup nor DN configured", i+1))
+		}
+		if g.MemberAttribute == "" {
+			g.MemberAttribute = cfg.MemberAttribute
+		}
+		switch strings.ToLower(g.MemberValueType) {
+		case "":
+			g.MemberValueType = cfg.MemberValueType
+		case ldapMemberUID:
+			g.MemberValueType = ldapMemberUID
+		case ldapMemberDN:
+			g.MemberValueType = ldapMemberDN
+		default:
+			configErrors = append(configErrors, fmt.Sprintf("Groups %d: MemberValueType must be uid or dn", i+1))
+		}
+		if len(g.Schedules) == 0 {
+			g.Schedules = cfg.Schedules
+		}
+	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		configErrors = append(configErrors, "Port is invalid")
+	}
+	if cfg.RootCAFile == "" {
+		cfg.RootCAFile = "truststore.pem"
+	}
+	if cfg.Server == "" {
+		configErrors = append(configErrors, "Server not configured")
+	}
+	if cfg.UserAttribute == "" {
+		cfg.UserAttribute = "uid"
+	}
+	return configErrors
+}
+
+func (cfg *deputizeLDAPConfig) Secrets() []string {
+	return []string{"LDAPModUserPassword"}
+}
+
+func (cfg *deputizeLDAPConfig) Update(ctx context.Context, run *sinkRun) ([]sinkChange, error) {
+	return updateLDAP(ctx, *cfg, run)
+}
+
+func updateLDAP(ctx context.Context, cfg deputizeLDAPConfig, run *sinkRun) ([]sinkChange, error) {
 	log.Printf("Beginning LDAP Update\n")
-	client, err := setupLDAPConnection(cfg.Server, cfg.Port, cfg.RootCAFile, cfg.InsecureSkipVerify)
+	client, err := setupLDAPConnection(ctx, cfg.Server, cfg.Port, cfg.TLSMode, cfg.RootCAFile, cfg.InsecureSkipVerify)
 	if err != nil {
-		return fmt.Errorf("unable to set up ldap client: %s", err)
+		return nil, fmt.Errorf("unable to set up ldap client: %s", err)
 	}
+	defer client.Close()
 
-	var resolvedLDAPOnCallUIDs []string
+	// We only bind when there's something to change, except for Active
+	// Directory, which doesn't allow anonymous searches
+	bound := false
+	bind := func() error {
+		if bound {
+			return nil
+		}
+		if err := client.Bind(cfg.ModUserDN, run.sec["LDAPModUserPassword"]); err != nil {
+			return fmt.Errorf("unable to bind to LDAP as %s", cfg.ModUserDN)
+		}
+		bound = true
+		return nil
+	}
+	if cfg.Directory == ldapDirectoryActiveDirectory {
+		if err := bind(); err != nil {
+			return nil, err
+		}
+	}
+
+	// memberValue finds the user matching filter, returning what goes in a
+	// group's MemberAttribute for them
+	memberValue := func(filter string, valueType string) (string, error) {
+		user, err := search(client, cfg.BaseDN, filter, []string{cfg.UserAttribute})
+		if err != nil {
+			return "", err
+		}
+		entry := user.Entries[0]
+		if valueType == ldapMemberDN {
+			return entry.DN, nil
+		}
+		value := entry.GetAttributeValue(cfg.UserAttribute)
+		if value == "" {
+			return "", fmt.Errorf("%s has no %s attribute", entry.DN, cfg.UserAttribute)
+		}
+		return value, nil
+	}
+	// userMemberValue is memberValue for a user given by their UserAttribute,
+	// as identities and fallbacks are
+	userMemberValue := func(uid string, valueType string) (string, error) {
+		if valueType == ldapMemberUID {
+			return uid, nil
+		}
+		value, err := memberValue(fmt.Sprintf("(%s=%s)", cfg.UserAttribute, ldap.EscapeFilter(uid)), valueType)
+		if err != nil {
+			return "", fmt.Errorf("unable to find LDAP user %s: %s", uid, err)
+		}
+		return value, nil
+	}
+	// resolve returns the member values for an on-call email. Groups can
+	// share people, so we remember who we've already looked up.
+	resolved := map[string][]string{}
+	resolve := func(email string, valueType string) ([]string, error) {
+		key := valueType + "\x00" + email
+		if values, ok := resolved[key]; ok {
+			return values, nil
+		}
+		var values []string
+		if uid := run.identities.lookup(email).LDAP; uid != "" {
+			value, err := userMemberValue(uid, valueType)
+			if err != nil {
+				return nil, err
+			}
+			values = []string{value}
+		} else {
+			value, err := memberValue(mailFilter(cfg.MailAttributes, email), valueType)
+			if errors.Is(err, errLDAPNoEntries) {
+				fallback, err := run.unresolvedUser(email)
+				if err != nil {
+					return nil, err
+				}
+				for _, uid := range fallback {
+					value, err := userMemberValue(uid, valueType)
+					if err != nil {
+						return nil, err
+					}
+					values = append(values, value)
+				}
+			} else if err != nil {
+				return nil, fmt.Errorf("unable to resolve emails from PD into LDAP members: %s", err)
+			} else {
+				values = []string{value}
+			}
+		}
+		resolved[key] = values
+		return values, nil
+	}
+
+	var changes []sinkChange
+	for _, group := range cfg.Groups {
+		change, err := updateLDAPGroup(ctx, cfg, group, client, resolve, bind, run)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	log.Printf("LDAP Update Complete.\n")
+	return changes, nil
+}
+
+// updateLDAPGroup brings one group's members in line with who's on call for
+// its schedules.
+func updateLDAPGroup(ctx context.Context, cfg deputizeLDAPConfig, group ldapGroup, client *ldap.Conn, resolve func(email string, valueType string) ([]string, error), bind func() error, run *sinkRun) (*sinkChange, error) {
+	pdOnCallEmails, err := run.oncall(ctx, group.Schedules)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the DN for the oncall group
+	onCallGroupDN := group.DN
+	if onCallGroupDN == "" {
+		onCallGroup, err := search(client, cfg.BaseDN, fmt.Sprintf("(%s)", group.OnCallGroup), []string{"cn"})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get LDAP OnCall Group DN for %s: %s", group.OnCallGroup, err)
+		}
+		onCallGroupDN = onCallGroup.Entries[0].DN
+	}
+	log.Printf("On Call Group DN: %s\n", onCallGroupDN)
 
 	// get current members of the oncall group (needed for removal later)
-	currentLDAPOnCall, err := search(client, cfg.BaseDN, fmt.Sprintf("(%s)", cfg.OnCallGroup), []string{cfg.MemberAttribute})
+	currentLDAPOnCallUIDs, err := groupMembers(client, onCallGroupDN, group.MemberAttribute)
 	if err != nil {
-		return fmt.Errorf("unable to get current on call from LDAP: %s", err)
+		return nil, fmt.Errorf("unable to get current on call from LDAP group %s: %s", onCallGroupDN, err)
 	}
-	currentLDAPOnCallUIDs := currentLDAPOnCall.Entries[0].GetAttributeValues(cfg.MemberAttribute)
-	// yeah, we *shouldnt* need to do this, but I want to make sure
-	// both slices are sorted the same way so DeepEqual works
 	currentLDAPOnCallUIDs = removeDuplicates(currentLDAPOnCallUIDs)
-	log.Printf("Current LDAP OnCall UIDs: %s\n", strings.Join(currentLDAPOnCallUIDs, ","))
+	log.Printf("Current LDAP OnCall Members: %s\n", strings.Join(currentLDAPOnCallUIDs, ","))
 
-	// Resolve the emails from PD to UIDs that we can use to determine if we need to update LDAP
+	// Resolve the emails from PD to members that we can use to determine if we need to update LDAP
+	var resolvedLDAPOnCallUIDs []string
 	for _, email := range pdOnCallEmails {
-		newOnCall, err := search(client, cfg.BaseDN, fmt.Sprintf("(%s=%s)", cfg.MailAttribute, email), []string{cfg.UserAttribute})
+		values, err := resolve(email, group.MemberValueType)
 		if err != nil {
-			return fmt.Errorf("unable to resolve emails from PD into LDAP UIDs: %s", err)
+			return nil, err
 		}
-		resolvedLDAPOnCallUIDs = append(resolvedLDAPOnCallUIDs, newOnCall.Entries[0].GetAttributeValue("uid"))
+		resolvedLDAPOnCallUIDs = append(resolvedLDAPOnCallUIDs, values...)
 	}
 	resolvedLDAPOnCallUIDs = removeDuplicates(resolvedLDAPOnCallUIDs)
-	log.Printf("Resolved New LDAP OnCall UIDs: %s\n", strings.Join(resolvedLDAPOnCallUIDs, ","))
+	log.Printf("Resolved New LDAP OnCall Members: %s\n", strings.Join(resolvedLDAPOnCallUIDs, ","))
 
-	// Get the DN for the oncall group
-	onCallGroup, err := search(client, cfg.BaseDN, fmt.Sprintf("(%s)", cfg.OnCallGroup), []string{"cn"})
-	if err != nil {
-		return fmt.Errorf("unable to get LDAP OnCall Group DN: %s", err)
+	addMembers, removeMembers := ldapMemberChanges(currentLDAPOnCallUIDs, resolvedLDAPOnCallUIDs, group.MemberValueType)
+	if len(addMembers) == 0 && len(removeMembers) == 0 {
+		return nil, nil
 	}
-	onCallGroupDN := onCallGroup.Entries[0].DN
-	log.Printf("On Call Group DN: %s\n", onCallGroupDN)
 
-	// If they're not the same, then theres a difference and we need to update LDAP
-	if !reflect.DeepEqual(currentLDAPOnCallUIDs, resolvedLDAPOnCallUIDs) {
-		if err := client.Bind(cfg.ModUserDN, ldappw); err != nil {
-			return fmt.Errorf("unable to bind to LDAP as %s", cfg.ModUserDN)
-		}
+	change := &sinkChange{
+		Target: onCallGroupDN,
+		Add:    addMembers,
+		Remove: removeMembers,
+	}
+	if run.dryRun {
+		log.Printf("Dry run, not updating LDAP group: %s\n", onCallGroupDN)
+		return change, nil
+	}
 
-		if len(currentLDAPOnCallUIDs) > 0 {
-			delUsers := ldap.NewModifyRequest(onCallGroupDN)
-			delUsers.Delete(cfg.MemberAttribute, currentLDAPOnCallUIDs)
-			if err = client.Modify(delUsers); err != nil {
-				return fmt.Errorf("unable to delete existing users from LDAP: %s", err)
-			}
-		}
-		if len(resolvedLDAPOnCallUIDs) > 0 {
-			addUsers := ldap.NewModifyRequest(onCallGroupDN)
-			addUsers.Add(cfg.MemberAttribute, resolvedLDAPOnCallUIDs)
-			if err = client.Modify(addUsers); err != nil {
-				return fmt.Errorf("unable to add new users to LDAP: %s", err)
-			}
-		}
+	if err := bind(); err != nil {
+		return nil, err
 	}
-	log.Printf("LDAP Update Complete.\n")
-	return nil
+
+	// One request, so the group is never left half updated
+	modify := ldap.NewModifyRequest(onCallGroupDN)
+	if len(addMembers) > 0 {
+		modify.Add(group.MemberAttribute, addMembers)
+	}
+	if len(removeMembers) > 0 {
+		modify.Delete(group.MemberAttribute, removeMembers)
+	}
+	if err = client.Modify(modify); err != nil {
+		return nil, fmt.Errorf("unable to update LDAP group %s members: %s", onCallGroupDN, err)
+	}
+	return change, nil
 }
 
-func setupLDAPConnection(host string, port int, cafile string, insecureSkipVerify bool) (*ldap.Conn, error) {
-	l, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
-	if err != nil {
-		return nil, err
+// ldapMemberChanges works out which members to add to and remove from a
+// group to go from current to resolved. DNs aren't case sensitive.
+func ldapMemberChanges(current []string, resolved []string, valueType string) ([]string, []string) {
+	diff := difference
+	if valueType == ldapMemberDN {
+		diff = differenceFold
 	}
+	return diff(resolved, current), diff(current, resolved)
+}
+
+// setupLDAPConnection connects to the server over TLS, either with StartTLS
+// or LDAPS depending on tlsMode. The connection is closed when ctx is done,
+// so a hung server can't outlive the sink timeout.
+func setupLDAPConnection(ctx context.Context, host string, port int, tlsMode string, cafile string, insecureSkipVerify bool) (*ldap.Conn, error) {
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: insecureSkipVerify,
 		ServerName:         host,
@@ -96,17 +416,117 @@ func setupLDAPConnection(host string, port int, cafile string, insecureSkipVerif
 		return nil, fmt.Errorf("unable to read trusted CAs from %s: %s", cafile, err)
 	}
 	if !rootCerts.AppendCertsFromPEM(rootCAFile) {
-		return nil, fmt.Errorf("unable to append to trust store: %s", err)
+		return nil, fmt.Errorf("unable to append to trust store from %s", cafile)
 	}
 	tlsConfig.RootCAs = rootCerts
-	tlsErr := l.StartTLS(tlsConfig)
-	if tlsErr != nil {
-		return nil, fmt.Errorf("unable to start TLS connection: %s", err)
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	if tlsMode == ldapTLSLDAPS {
+		tlsConn := tls.Client(c, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("unable to start TLS connection: %s", err)
+		}
+		c = tlsConn
+	}
+	l := ldap.NewConn(c, tlsMode == ldapTLSLDAPS)
+	l.Start()
+	if deadline, ok := ctx.Deadline(); ok {
+		l.SetTimeout(time.Until(deadline))
+	}
+	context.AfterFunc(ctx, func() { l.Close() })
+	if tlsMode == ldapTLSStartTLS {
+		if err := l.StartTLS(tlsConfig); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("unable to start TLS connection: %s", err)
+		}
 	}
 
 	return l, nil
 }
 
+// mailFilter builds a filter matching users with email in any of attributes.
+func mailFilter(attributes []string, email string) string {
+	if len(attributes) == 1 {
+		return fmt.Sprintf("(%s=%s)", attributes[0], ldap.EscapeFilter(email))
+	}
+	filter := "(|"
+	for _, attr := range attributes {
+		filter += fmt.Sprintf("(%s=%s)", attr, ldap.EscapeFilter(email))
+	}
+	return filter + ")"
+}
+
+// groupMembers returns the values of attr on the group at dn. Active
+// Directory only returns so many values of an attribute at once (1500 by
+// default), handing back member;range=0-1499 instead of member, so we follow
+// the ranges until we have them all.
+func groupMembers(l *ldap.Conn, dn string, attr string) ([]string, error) {
+	var values []string
+	request := attr
+	for request != "" {
+		searchRequest := ldap.NewSearchRequest(
+			dn,
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)",
+			[]string{request},
+			nil,
+		)
+		sr, err := l.Search(searchRequest)
+		if err != nil {
+			return nil, err
+		}
+		if len(sr.Entries) != 1 {
+			return nil, fmt.Errorf("group %s not found", dn)
+		}
+
+		found, next, err := ldapRangeValues(attr, sr.Entries[0].Attributes)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, found...)
+		request = next
+	}
+	return values, nil
+}
+
+// ldapRangeValues picks the values of attr out of a search result, whether
+// they came back whole or as a range (member;range=0-1499). It also returns
+// the attribute to ask for to get the next range, or "" if that was the last.
+func ldapRangeValues(attr string, attributes []*ldap.EntryAttribute) ([]string, string, error) {
+	var values []string
+	next := ""
+	for _, a := range attributes {
+		if strings.EqualFold(a.Name, attr) {
+			values = append(values, a.Values...)
+			continue
+		}
+		name, options, _ := strings.Cut(a.Name, ";")
+		rng, ok := strings.CutPrefix(strings.ToLower(options), "range=")
+		if !strings.EqualFold(name, attr) || !ok {
+			continue
+		}
+		values = append(values, a.Values...)
+		// The last range ends in *, otherwise ask for the next one
+		_, end, _ := strings.Cut(rng, "-")
+		if end != "*" {
+			n, err := strconv.Atoi(end)
+			if err != nil {
+				return nil, "", fmt.Errorf("unexpected range in %s", a.Name)
+			}
+			next = fmt.Sprintf("%s;range=%d-*", attr, n+1)
+		}
+	}
+	return values, next, nil
+}
+
+// errLDAPNoEntries is returned by search when nothing matches.
+var errLDAPNoEntries = errors.New("user does not exist")
+
 // This is only good for things you know will return only one result. Be warned.
 func search(l *ldap.Conn, basedn string, search string, attributes []string) (*ldap.SearchResult, error) {
 	searchRequest := ldap.NewSearchRequest(
@@ -121,8 +541,11 @@ func search(l *ldap.Conn, basedn string, search string, attributes []string) (*l
 		return nil, err
 	}
 
+	if len(sr.Entries) == 0 {
+		return nil, errLDAPNoEntries
+	}
 	if len(sr.Entries) != 1 {
-		return nil, fmt.Errorf("user does not exist or too many entries returned")
+		return nil, fmt.Errorf("too many entries returned")
 	}
 
 	return sr, nil
@@ -0,0 +1,327 @@
+// mod_ldap_test.go - tests for the LDAP sink
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/ldap.v2"
+)
+
+// testLDAPConfig is a valid LDAP sink config.
+func testLDAPConfig() deputizeLDAPConfig {
+	return deputizeLDAPConfig{
+		Server:      "ldap.example.com",
+		Port:        389,
+		BaseDN:      "dc=example,dc=com",
+		ModUserDN:   "cn=deputize,dc=example,dc=com",
+		OnCallGroup: "cn=oncall",
+	}
+}
+
+func TestLDAPValidateMemberValueType(t *testing.T) {
+	tests := []struct {
+		name            string
+		memberValueType string
+		want            string
+		wantErr         bool
+	}{
+		{"default", "", ldapMemberUID, false},
+		{"uid", "uid", ldapMemberUID, false},
+		{"dn", "DN", ldapMemberDN, false},
+		{"unknown", "cn", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testLDAPConfig()
+			cfg.MemberValueType = tt.memberValueType
+			errs := cfg.Validate()
+			if (len(errs) > 0) != tt.wantErr {
+				t.Fatalf("Validate() = %q, wantErr %v", errs, tt.wantErr)
+			}
+			if !tt.wantErr && cfg.MemberValueType != tt.want {
+				t.Errorf("MemberValueType = %q, want %q", cfg.MemberValueType, tt.want)
+			}
+		})
+	}
+}
+
+func TestLDAPValidateDefaults(t *testing.T) {
+	cfg := testLDAPConfig()
+	if errs := cfg.Validate(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if cfg.UserAttribute != "uid" || cfg.MailAttribute != "mail" || cfg.MemberAttribute != "memberOf" {
+		t.Errorf("UserAttribute %q MailAttribute %q MemberAttribute %q, want uid, mail and memberOf", cfg.UserAttribute, cfg.MailAttribute, cfg.MemberAttribute)
+	}
+}
+
+func TestLDAPValidateDirectory(t *testing.T) {
+	tests := []struct {
+		name          string
+		directory     string
+		tlsMode       string
+		port          int
+		wantTLSMode   string
+		wantPort      int
+		wantMail      []string
+		wantMember    string
+		wantValueType string
+		wantUserAttr  string
+		wantErr       bool
+	}{
+		{"OpenLDAP", "", "", 0, ldapTLSStartTLS, 389, []string{"mail"}, "memberOf", ldapMemberUID, "uid", false},
+		{"OpenLDAP over LDAPS", "openldap", "ldaps", 0, ldapTLSLDAPS, 636, []string{"mail"}, "memberOf", ldapMemberUID, "uid", false},
+		{"Active Directory", "activedirectory", "", 0, ldapTLSLDAPS, 636, []string{"mail", "userPrincipalName"}, "member", ldapMemberDN, "sAMAccountName", false},
+		{"Active Directory with StartTLS", "ActiveDirectory", "StartTLS", 3268, ldapTLSStartTLS, 3268, []string{"mail", "userPrincipalName"}, "member", ldapMemberDN, "sAMAccountName", false},
+		{"unknown directory", "eDirectory", "", 0, "", 0, nil, "", "", "", true},
+		{"unknown TLS mode", "", "none", 0, "", 0, nil, "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testLDAPConfig()
+			cfg.Directory = tt.directory
+			cfg.TLSMode = tt.tlsMode
+			cfg.Port = tt.port
+			errs := cfg.Validate()
+			if (len(errs) > 0) != tt.wantErr {
+				t.Fatalf("Validate() = %q, wantErr %v", errs, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if cfg.TLSMode != tt.wantTLSMode || cfg.Port != tt.wantPort {
+				t.Errorf("TLSMode %s Port %d, want %s %d", cfg.TLSMode, cfg.Port, tt.wantTLSMode, tt.wantPort)
+			}
+			if !reflect.DeepEqual(cfg.MailAttributes, tt.wantMail) || cfg.MemberAttribute != tt.wantMember || cfg.MemberValueType != tt.wantValueType || cfg.UserAttribute != tt.wantUserAttr {
+				t.Errorf("MailAttributes %q MemberAttribute %s MemberValueType %s UserAttribute %s, want %q %s %s %s",
+					cfg.MailAttributes, cfg.MemberAttribute, cfg.MemberValueType, cfg.UserAttribute,
+					tt.wantMail, tt.wantMember, tt.wantValueType, tt.wantUserAttr)
+			}
+		})
+	}
+}
+
+func TestLDAPRangeValues(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes []*ldap.EntryAttribute
+		values     []string
+		next       string
+		wantErr    bool
+	}{
+		{
+			name:       "whole attribute",
+			attributes: []*ldap.EntryAttribute{{Name: "member", Values: []string{"a", "b"}}},
+			values:     []string{"a", "b"},
+		},
+		{
+			name:       "attribute name case",
+			attributes: []*ldap.EntryAttribute{{Name: "Member", Values: []string{"a"}}},
+			values:     []string{"a"},
+		},
+		{
+			name:       "first range",
+			attributes: []*ldap.EntryAttribute{{Name: "member;range=0-1499", Values: []string{"a", "b"}}},
+			values:     []string{"a", "b"},
+			next:       "member;range=1500-*",
+		},
+		{
+			name:       "middle range",
+			attributes: []*ldap.EntryAttribute{{Name: "member;Range=1500-2999", Values: []string{"c"}}},
+			values:     []string{"c"},
+			next:       "member;range=3000-*",
+		},
+		{
+			name:       "last range",
+			attributes: []*ldap.EntryAttribute{{Name: "member;range=3000-*", Values: []string{"d"}}},
+			values:     []string{"d"},
+		},
+		{
+			name: "other attributes ignored",
+			attributes: []*ldap.EntryAttribute{
+				{Name: "cn", Values: []string{"oncall"}},
+				{Name: "memberOf;range=0-1", Values: []string{"x"}},
+				{Name: "member;lang-en", Values: []string{"y"}},
+			},
+		},
+		{
+			name:       "no members",
+			attributes: nil,
+		},
+		{
+			name:       "bad range end",
+			attributes: []*ldap.EntryAttribute{{Name: "member;range=0-lots", Values: []string{"a"}}},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, next, err := ldapRangeValues("member", tt.attributes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(values, tt.values) {
+				t.Errorf("values = %q, want %q", values, tt.values)
+			}
+			if next != tt.next {
+				t.Errorf("next = %q, want %q", next, tt.next)
+			}
+		})
+	}
+}
+
+func TestMailFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes []string
+		email      string
+		want       string
+	}{
+		{"one attribute", []string{"mail"}, "alice@example.com", "(mail=alice@example.com)"},
+		{"several attributes", []string{"mail", "userPrincipalName"}, "alice@example.com", "(|(mail=alice@example.com)(userPrincipalName=alice@example.com))"},
+		{"escaped", []string{"mail"}, "a*)(uid=*", `(mail=a\2a\29\28uid=\2a)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mailFilter(tt.attributes, tt.email); got != tt.want {
+				t.Errorf("mailFilter() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLDAPMemberChanges(t *testing.T) {
+	tests := []struct {
+		name      string
+		current   []string
+		resolved  []string
+		valueType string
+		add       []string
+		remove    []string
+	}{
+		{
+			name:      "unchanged",
+			current:   []string{"alice", "bob"},
+			resolved:  []string{"alice", "bob"},
+			valueType: ldapMemberUID,
+		},
+		{
+			name:      "reordered",
+			current:   []string{"bob", "alice"},
+			resolved:  []string{"alice", "bob"},
+			valueType: ldapMemberUID,
+		},
+		{
+			name:      "handoff",
+			current:   []string{"alice", "bob"},
+			resolved:  []string{"bob", "carol"},
+			valueType: ldapMemberUID,
+			add:       []string{"carol"},
+			remove:    []string{"alice"},
+		},
+		{
+			name:      "empty group",
+			resolved:  []string{"alice"},
+			valueType: ldapMemberUID,
+			add:       []string{"alice"},
+		},
+		{
+			name:      "nobody on call",
+			current:   []string{"alice"},
+			valueType: ldapMemberUID,
+			remove:    []string{"alice"},
+		},
+		{
+			name:      "uids are case sensitive",
+			current:   []string{"Alice"},
+			resolved:  []string{"alice"},
+			valueType: ldapMemberUID,
+			add:       []string{"alice"},
+			remove:    []string{"Alice"},
+		},
+		{
+			name:      "dns ignore case",
+			current:   []string{"CN=Alice,OU=Users,DC=example,DC=com"},
+			resolved:  []string{"cn=alice,ou=users,dc=example,dc=com", "cn=bob,ou=users,dc=example,dc=com"},
+			valueType: ldapMemberDN,
+			add:       []string{"cn=bob,ou=users,dc=example,dc=com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			add, remove := ldapMemberChanges(tt.current, tt.resolved, tt.valueType)
+			if !reflect.DeepEqual(add, tt.add) {
+				t.Errorf("add = %q, want %q", add, tt.add)
+			}
+			if !reflect.DeepEqual(remove, tt.remove) {
+				t.Errorf("remove = %q, want %q", remove, tt.remove)
+			}
+		})
+	}
+}
+
+func TestLDAPValidateGroups(t *testing.T) {
+	cfg := testLDAPConfig()
+	cfg.OnCallGroup = ""
+	cfg.MemberValueType = "dn"
+	cfg.Schedules = []string{"Primary"}
+	cfg.Groups = []ldapGroup{
+		{OnCallGroup: "cn=oncall-primary"},
+		{DN: "cn=oncall-db,ou=groups,dc=example,dc=com", MemberAttribute: "memberUid", MemberValueType: "UID", Schedules: []string{"Database"}},
+	}
+	if errs := cfg.Validate(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	want := []ldapGroup{
+		{OnCallGroup: "cn=oncall-primary", MemberAttribute: "memberOf", MemberValueType: ldapMemberDN, Schedules: []string{"Primary"}},
+		{DN: "cn=oncall-db,ou=groups,dc=example,dc=com", MemberAttribute: "memberUid", MemberValueType: ldapMemberUID, Schedules: []string{"Database"}},
+	}
+	if !reflect.DeepEqual(cfg.Groups, want) {
+		t.Errorf("Groups = %+v, want %+v", cfg.Groups, want)
+	}
+}
+
+func TestLDAPValidateOnCallGroup(t *testing.T) {
+	cfg := testLDAPConfig()
+	if errs := cfg.Validate(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	want := []ldapGroup{{OnCallGroup: "cn=oncall", MemberAttribute: "memberOf", MemberValueType: ldapMemberUID}}
+	if !reflect.DeepEqual(cfg.Groups, want) {
+		t.Errorf("Groups = %+v, want %+v", cfg.Groups, want)
+	}
+	// serve validates the same config before every run
+	if errs := cfg.Validate(); len(errs) > 0 {
+		t.Errorf("second Validate() = %q", errs)
+	}
+}
+
+func TestLDAPValidateGroupErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		onCallGroup string
+		groups      []ldapGroup
+	}{
+		{"no groups", "", nil},
+		{"group without a filter or DN", "", []ldapGroup{{Schedules: []string{"Primary"}}}},
+		{"bad group MemberValueType", "", []ldapGroup{{OnCallGroup: "cn=oncall", MemberValueType: "cn"}}},
+		{"OnCallGroup and Groups", "cn=oncall", []ldapGroup{{OnCallGroup: "cn=oncall-primary"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testLDAPConfig()
+			cfg.OnCallGroup = tt.onCallGroup
+			cfg.Groups = tt.groups
+			if errs := cfg.Validate(); len(errs) == 0 {
+				t.Error("Validate() succeeded, want an error")
+			}
+		})
+	}
+}
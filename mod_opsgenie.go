@@ -0,0 +1,137 @@
+// mod_opsgenie.go - Opsgenie source code
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type deputizeOpsgenieConfig struct {
+	Enabled bool
+	// APIURL is the Opsgenie API endpoint; use https://api.eu.opsgenie.com
+	// for EU accounts.
+	APIURL string
+	// OnCallSchedules are schedule names or IDs.
+	OnCallSchedules []string
+}
+
+// opsgenieParticipant is an entry in the on-call participant tree Opsgenie
+// returns. Escalations and rotations nest the people on call under them.
+type opsgenieParticipant struct {
+	ID                 string                `json:"id"`
+	Name               string                `json:"name"`
+	Type               string                `json:"type"`
+	OnCallParticipants []opsgenieParticipant `json:"onCallParticipants"`
+}
+
+type opsgenieOnCallResponse struct {
+	Data struct {
+		OnCallParticipants []opsgenieParticipant `json:"onCallParticipants"`
+	} `json:"data"`
+}
+
+var opsgenieIDRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func init() {
+	registerSource("Opsgenie", func() Source { return &deputizeOpsgenieConfig{} })
+}
+
+func (cfg *deputizeOpsgenieConfig) Validate() []string {
+	var configErrors []string
+	if cfg.APIURL == "" {
+		cfg.APIURL = "https://api.opsgenie.com"
+	}
+	cfg.APIURL = strings.TrimSuffix(cfg.APIURL, "/")
+	if len(cfg.OnCallSchedules) == 0 {
+		configErrors = append(configErrors, "No On Call Schedules Selected")
+	}
+	return configErrors
+}
+
+func (cfg *deputizeOpsgenieConfig) Secrets() []string {
+	return []string{"OpsgenieAPIKey"}
+}
+
+func (cfg *deputizeOpsgenieConfig) Schedules() []string {
+	return cfg.OnCallSchedules
+}
+
+func (cfg *deputizeOpsgenieConfig) OnCall(ctx context.Context, sec deputizeSecrets, schedule string) ([]string, error) {
+	return getOpsgenieInfo(ctx, cfg.APIURL, sec["OpsgenieAPIKey"], []string{schedule}, time.Time{})
+}
+
+func (cfg *deputizeOpsgenieConfig) OnCallAt(ctx context.Context, sec deputizeSecrets, schedule string, at time.Time) ([]string, error) {
+	return getOpsgenieInfo(ctx, cfg.APIURL, sec["OpsgenieAPIKey"], []string{schedule}, at)
+}
+
+// getOpsgenieInfo returns the emails of the people on call for schedules at
+// the given time, or now if it's zero.
+func getOpsgenieInfo(ctx context.Context, apiURL string, apiKey string, schedules []string, at time.Time) ([]string, error) {
+	var newOnCallEmails []string
+	client := &http.Client{Timeout: httpTimeout}
+
+	for _, sch := range schedules {
+		// Schedules can be referenced by ID or by name
+		identifierType := "name"
+		if opsgenieIDRegexp.MatchString(sch) {
+			identifierType = "id"
+		}
+		params := url.Values{}
+		params.Add("scheduleIdentifierType", identifierType)
+		params.Add("flat", "false")
+		if !at.IsZero() {
+			params.Add("date", at.Format(time.RFC3339))
+		}
+		endpoint := fmt.Sprintf("%s/v2/schedules/%s/on-calls?%s", apiURL, url.PathEscape(sch), params.Encode())
+
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+		if err != nil {
+			return []string{}, fmt.Errorf("unable to build Opsgenie request: %s", err)
+		}
+		req.Header.Set("Authorization", "GenieKey "+apiKey)
+		resp, err := client.Do(req)
+		if err != nil {
+			return []string{}, fmt.Errorf("unable to talk to Opsgenie: %s", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return []string{}, fmt.Errorf("unable to read Opsgenie body: %s", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return []string{}, fmt.Errorf("unable to get on-calls for schedule %s: %s: %s", sch, resp.Status, body)
+		}
+
+		var oncall opsgenieOnCallResponse
+		if err := json.Unmarshal(body, &oncall); err != nil {
+			return []string{}, fmt.Errorf("unable to parse json: %s", err)
+		}
+		newOnCallEmails = append(newOnCallEmails, flattenOpsgenieParticipants(oncall.Data.OnCallParticipants)...)
+	}
+
+	return removeDuplicates(newOnCallEmails), nil
+}
+
+// flattenOpsgenieParticipants walks the participant tree, returning the
+// usernames (emails) of the users in it. Escalations and rotations are
+// expanded into the people on call for them.
+func flattenOpsgenieParticipants(participants []opsgenieParticipant) []string {
+	var emails []string
+	for _, p := range participants {
+		if p.Type == "user" {
+			emails = append(emails, p.Name)
+		}
+		emails = append(emails, flattenOpsgenieParticipants(p.OnCallParticipants)...)
+	}
+	return emails
+}
@@ -0,0 +1,93 @@
+// mod_opsgenie_test.go - tests for the Opsgenie source
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlattenOpsgenieParticipants(t *testing.T) {
+	tests := []struct {
+		name         string
+		participants []opsgenieParticipant
+		want         []string
+	}{
+		{"nobody", nil, nil},
+		{"users", []opsgenieParticipant{
+			{Name: "alice@example.com", Type: "user"},
+			{Name: "bob@example.com", Type: "user"},
+		}, []string{"alice@example.com", "bob@example.com"}},
+		{"nested", []opsgenieParticipant{
+			{Name: "Ops escalation", Type: "escalation", OnCallParticipants: []opsgenieParticipant{
+				{Name: "Ops rotation", Type: "rotation", OnCallParticipants: []opsgenieParticipant{
+					{Name: "alice@example.com", Type: "user"},
+				}},
+			}},
+			{Name: "Ops team", Type: "team"},
+		}, []string{"alice@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := flattenOpsgenieParticipants(tt.participants); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flattenOpsgenieParticipants() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetOpsgenieInfo(t *testing.T) {
+	tests := []struct {
+		name           string
+		schedule       string
+		identifierType string
+		at             time.Time
+		date           string
+		status         int
+		want           []string
+		wantErr        bool
+	}{
+		{"by name", "Ops", "name", time.Time{}, "", http.StatusOK, []string{"alice@example.com"}, false},
+		{"by ID", "0b0e8d0e-6b2a-4c3c-9d8e-5f2e9b1a7c11", "id", time.Time{}, "", http.StatusOK, []string{"alice@example.com"}, false},
+		{"in the past", "Ops", "name", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), "2024-03-01T12:00:00Z", http.StatusOK, []string{"alice@example.com"}, false},
+		{"not found", "Nope", "name", time.Time{}, "", http.StatusNotFound, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "GenieKey secret" {
+					t.Errorf("Authorization = %q", got)
+				}
+				if r.URL.Path != "/v2/schedules/"+tt.schedule+"/on-calls" {
+					t.Errorf("path = %q", r.URL.Path)
+				}
+				if got := r.URL.Query().Get("scheduleIdentifierType"); got != tt.identifierType {
+					t.Errorf("scheduleIdentifierType = %q, want %q", got, tt.identifierType)
+				}
+				if got := r.URL.Query().Get("date"); got != tt.date {
+					t.Errorf("date = %q, want %q", got, tt.date)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"data": {"onCallParticipants": [
+					{"name": "alice@example.com", "type": "user"},
+					{"name": "Ops rotation", "type": "rotation", "onCallParticipants": [{"name": "alice@example.com", "type": "user"}]}
+				]}}`))
+			}))
+			defer srv.Close()
+
+			got, err := getOpsgenieInfo(context.Background(), srv.URL, "secret", []string{tt.schedule}, tt.at)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getOpsgenieInfo() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,56 +6,485 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/PagerDuty/go-pagerduty"
 )
 
-func getPagerdutyInfo(ctx context.Context, withOAuth bool, authToken string, schedules []string) ([]string, error) {
-	var newOnCallEmails []string
-	var pdClient *pagerduty.Client
+type deputizePDConfig struct {
+	Enabled bool
+	// OnCallSchedules are schedule names or IDs.
+	OnCallSchedules []string
+	// EscalationPolicies select who's on call by escalation policy and level,
+	// under names that sinks and pipelines use like schedules.
+	EscalationPolicies []pdEscalationPolicy
+	WithOAuth          bool
+	OAuthSecretPath    string
+
+	// one client is shared by every lookup in a run
+	clientOnce sync.Once
+	client     *pagerduty.Client
+}
+
+// pdEscalationPolicy picks the people on call at some levels of an
+// escalation policy.
+type pdEscalationPolicy struct {
+	// Name is what sinks and pipelines call this selection in their Schedules.
+	Name string
+	// Policy is the ID or name of the escalation policy.
+	Policy string
+	// Levels to include, e.g. [1] for just the primary responders. Leave
+	// empty for every level.
+	Levels []uint
+}
+
+func init() {
+	registerSource("PagerDuty", func() Source { return &deputizePDConfig{} })
+}
+
+func (cfg *deputizePDConfig) Validate() []string {
+	var configErrors []string
+	if len(cfg.OnCallSchedules) == 0 && len(cfg.EscalationPolicies) == 0 {
+		configErrors = append(configErrors, "No On Call Groups Selected")
+	}
+	names := map[string]bool{}
+	for _, sch := range cfg.OnCallSchedules {
+		names[sch] = true
+	}
+	for i, ep := range cfg.EscalationPolicies {
+		if ep.Name == "" {
+			configErrors = append(configErrors, fmt.Sprintf("EscalationPolicies %d: Name not configured", i+1))
+		} else if names[ep.Name] {
+			configErrors = append(configErrors, fmt.Sprintf("EscalationPolicies %s: Name is already used by a schedule or escalation policy", ep.Name))
+		}
+		names[ep.Name] = true
+		if ep.Policy == "" {
+			configErrors = append(configErrors, fmt.Sprintf("EscalationPolicies %d: Policy not configured", i+1))
+		}
+		for _, level := range ep.Levels {
+			if level < 1 {
+				configErrors = append(configErrors, fmt.Sprintf("EscalationPolicies %d: Levels start at 1", i+1))
+			}
+		}
+	}
+	if cfg.WithOAuth {
+		if cfg.OAuthSecretPath == "" {
+			configErrors = append(configErrors, "OAuth enabled, but OAuthSecretPath is not configured")
+		}
+	}
+	return configErrors
+}
+
+func (cfg *deputizePDConfig) Secrets() []string {
+	return []string{"PDAuthToken"}
+}
 
-	if withOAuth {
-		pdClient = pagerduty.NewOAuthClient(authToken)
-	} else {
-		pdClient = pagerduty.NewClient(authToken)
+// LoadSecrets swaps in the OAuth token kept up to date by pdrotator when
+// WithOAuth is set.
+func (cfg *deputizePDConfig) LoadSecrets(ctx context.Context, provider SecretProvider, sec deputizeSecrets) error {
+	if !cfg.WithOAuth {
+		return nil
 	}
+	token, err := provider.Secret(ctx, cfg.OAuthSecretPath)
+	if err != nil {
+		return fmt.Errorf("could not get PD OAuth secret: %s", err)
+	}
+	sec["PDAuthToken"] = token
+	return nil
+}
 
-	var allRawSchedulesPD [][]pagerduty.Schedule
+func (cfg *deputizePDConfig) Schedules() []string {
+	schedules := slices.Clone(cfg.OnCallSchedules)
+	for _, ep := range cfg.EscalationPolicies {
+		schedules = append(schedules, ep.Name)
+	}
+	return schedules
+}
 
-	for _, sch := range schedules {
-		lsSchedulesOpts := pagerduty.ListSchedulesOptions{
-			Total: true,
-			Query: sch,
+func (cfg *deputizePDConfig) OnCall(ctx context.Context, sec deputizeSecrets, schedule string) ([]string, error) {
+	return cfg.OnCallWindow(ctx, sec, schedule, onCallWindow{})
+}
+
+func (cfg *deputizePDConfig) OnCallWindow(ctx context.Context, sec deputizeSecrets, schedule string, window onCallWindow) ([]string, error) {
+	if ep := cfg.escalationPolicy(schedule); ep != nil {
+		return getPagerdutyEscalationInfo(ctx, cfg.pdClient(sec), *ep, time.Now(), window)
+	}
+	return getPagerdutyInfo(ctx, cfg.pdClient(sec), []string{schedule}, time.Now(), window)
+}
+
+func (cfg *deputizePDConfig) OnCallAt(ctx context.Context, sec deputizeSecrets, schedule string, at time.Time) ([]string, error) {
+	if ep := cfg.escalationPolicy(schedule); ep != nil {
+		return getPagerdutyEscalationInfo(ctx, cfg.pdClient(sec), *ep, at, onCallWindow{})
+	}
+	return getPagerdutyInfo(ctx, cfg.pdClient(sec), []string{schedule}, at, onCallWindow{})
+}
+
+func (cfg *deputizePDConfig) Shifts(ctx context.Context, sec deputizeSecrets, schedule string, from time.Time, until time.Time) ([]onCallShift, error) {
+	return getPagerdutyShifts(ctx, cfg.pdClient(sec), schedule, cfg.escalationPolicy(schedule), from, until)
+}
+
+func (cfg *deputizePDConfig) OpenIncidents(ctx context.Context, sec deputizeSecrets, email string) ([]openIncident, error) {
+	return getPagerdutyIncidents(ctx, cfg.pdClient(sec), email)
+}
+
+// escalationPolicy returns the escalation policy selection with the given
+// name, or nil if it's a schedule.
+func (cfg *deputizePDConfig) escalationPolicy(name string) *pdEscalationPolicy {
+	for i := range cfg.EscalationPolicies {
+		if cfg.EscalationPolicies[i].Name == name {
+			return &cfg.EscalationPolicies[i]
 		}
-		reqSchedule, err := pdClient.ListSchedulesWithContext(ctx, lsSchedulesOpts)
+	}
+	return nil
+}
+
+// pagerdutyWindow returns the since and until times to ask PagerDuty who's on
+// call between. Anyone on call at any point in the window counts, so it
+// starts the window's GracePeriod before at and ends its LeadTime after. It's
+// always at least a second long.
+func pagerdutyWindow(at time.Time, window onCallWindow) (string, string) {
+	leadTime := window.LeadTime
+	if leadTime < time.Second {
+		leadTime = time.Second
+	}
+	since := at.Add(-window.GracePeriod).Format("2006-01-02T15:04:05Z07:00")
+	until := at.Add(leadTime).Format("2006-01-02T15:04:05Z07:00")
+	return since, until
+}
+
+func (cfg *deputizePDConfig) pdClient(sec deputizeSecrets) *pagerduty.Client {
+	cfg.clientOnce.Do(func() {
+		if cfg.WithOAuth {
+			cfg.client = pagerduty.NewOAuthClient(sec["PDAuthToken"])
+		} else {
+			cfg.client = pagerduty.NewClient(sec["PDAuthToken"])
+		}
+	})
+	return cfg.client
+}
+
+func getPagerdutyInfo(ctx context.Context, pdClient *pagerduty.Client, schedules []string, at time.Time, window onCallWindow) ([]string, error) {
+	var newOnCallEmails []string
+
+	for _, sch := range schedules {
+		scheduleID, err := pagerdutyScheduleID(ctx, pdClient, sch)
 		if err != nil {
 			return []string{}, err
 		}
 
-		allRawSchedulesPD = append(allRawSchedulesPD, reqSchedule.Schedules)
+		var onCallOpts pagerduty.ListOnCallUsersOptions
+		onCallOpts.Since, onCallOpts.Until = pagerdutyWindow(at, window)
+		if oncall, err := pdClient.ListOnCallUsersWithContext(ctx, scheduleID, onCallOpts); err != nil {
+			return []string{}, fmt.Errorf("unable to ListOnCallUsers: %s", err)
+		} else {
+			for _, person := range oncall {
+				newOnCallEmails = append(newOnCallEmails, person.Email)
+			}
+		}
 	}
 
-	allSchedulesPD := slices.Concat(allRawSchedulesPD...)
+	return newOnCallEmails, nil
+}
 
-	for _, p := range allSchedulesPD {
-		if contains(schedules, p.Name) {
-			var onCallOpts pagerduty.ListOnCallUsersOptions
-			var currentTime = time.Now()
-			onCallOpts.Since = currentTime.Format("2006-01-02T15:04:05Z07:00")
-			hours, _ := time.ParseDuration("1s")
-			onCallOpts.Until = currentTime.Add(hours).Format("2006-01-02T15:04:05Z07:00")
-			if oncall, err := pdClient.ListOnCallUsersWithContext(ctx, p.APIObject.ID, onCallOpts); err != nil {
-				return []string{}, fmt.Errorf("unable to ListOnCallUsers: %s", err)
-			} else {
-				for _, person := range oncall {
-					newOnCallEmails = append(newOnCallEmails, person.Email)
-				}
+// pagerdutyScheduleID returns the ID of the schedule referenced by name or by
+// ID. Names are tried first, so a schedule named like an ID (PRIMARY) still
+// works. A name must match exactly one schedule; the query PagerDuty does is
+// fuzzy, so we page through everything it finds looking for exact matches.
+func pagerdutyScheduleID(ctx context.Context, pdClient *pagerduty.Client, schedule string) (string, error) {
+	opts := pagerduty.ListSchedulesOptions{Limit: 100, Query: schedule}
+	var ids []string
+	for {
+		resp, err := pdClient.ListSchedulesWithContext(ctx, opts)
+		if err != nil {
+			return "", fmt.Errorf("unable to ListSchedules: %s", err)
+		}
+		for _, sch := range resp.Schedules {
+			if sch.Name == schedule {
+				ids = append(ids, sch.ID)
 			}
 		}
+		if !resp.More {
+			break
+		}
+		opts.Offset += opts.Limit
+	}
+	switch len(ids) {
+	case 0:
+		// Not a name, so try it as an ID
+		_, err := pdClient.GetScheduleWithContext(ctx, schedule, pagerduty.GetScheduleOptions{})
+		if pagerdutyNotFound(err) {
+			return "", fmt.Errorf("no schedule named or with the ID %s", schedule)
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to GetSchedule: %s", err)
+		}
+		return schedule, nil
+	case 1:
+		return ids[0], nil
 	}
+	return "", fmt.Errorf("schedule name %s is ambiguous, it matches %s; use the schedule ID instead", schedule, strings.Join(ids, ", "))
+}
 
-	return newOnCallEmails, nil
+// getPagerdutyEscalationInfo returns the emails of the people on call at the
+// selected levels of an escalation policy, over window around at.
+func getPagerdutyEscalationInfo(ctx context.Context, pdClient *pagerduty.Client, ep pdEscalationPolicy, at time.Time, window onCallWindow) ([]string, error) {
+	policyID, err := pagerdutyEscalationPolicyID(ctx, pdClient, ep.Policy)
+	if err != nil {
+		return []string{}, err
+	}
+
+	onCallOpts := pagerduty.ListOnCallOptions{
+		Limit:               100,
+		Includes:            []string{"users"},
+		EscalationPolicyIDs: []string{policyID},
+	}
+	onCallOpts.Since, onCallOpts.Until = pagerdutyWindow(at, window)
+	var newOnCallEmails []string
+	for {
+		resp, err := pdClient.ListOnCallsWithContext(ctx, onCallOpts)
+		if err != nil {
+			return []string{}, fmt.Errorf("unable to ListOnCalls: %s", err)
+		}
+		for _, oncall := range resp.OnCalls {
+			// go-pagerduty doesn't support the escalation_levels filter, so
+			// we pick the levels out ourselves
+			if len(ep.Levels) > 0 && !slices.Contains(ep.Levels, oncall.EscalationLevel) {
+				continue
+			}
+			newOnCallEmails = append(newOnCallEmails, oncall.User.Email)
+		}
+		if !resp.More {
+			break
+		}
+		onCallOpts.Offset += onCallOpts.Limit
+	}
+
+	return removeDuplicates(newOnCallEmails), nil
+}
+
+// pagerdutyEscalationPolicyID returns the ID of the escalation policy
+// referenced by name or by ID. As with schedules, names are tried first and
+// must match exactly one policy.
+func pagerdutyEscalationPolicyID(ctx context.Context, pdClient *pagerduty.Client, policy string) (string, error) {
+	opts := pagerduty.ListEscalationPoliciesOptions{Limit: 100, Query: policy}
+	var ids []string
+	for {
+		resp, err := pdClient.ListEscalationPoliciesWithContext(ctx, opts)
+		if err != nil {
+			return "", fmt.Errorf("unable to ListEscalationPolicies: %s", err)
+		}
+		for _, ep := range resp.EscalationPolicies {
+			if ep.Name == policy {
+				ids = append(ids, ep.ID)
+			}
+		}
+		if !resp.More {
+			break
+		}
+		opts.Offset += opts.Limit
+	}
+	switch len(ids) {
+	case 0:
+		// Not a name, so try it as an ID
+		_, err := pdClient.GetEscalationPolicyWithContext(ctx, policy, &pagerduty.GetEscalationPolicyOptions{})
+		if pagerdutyNotFound(err) {
+			return "", fmt.Errorf("no escalation policy named or with the ID %s", policy)
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to GetEscalationPolicy: %s", err)
+		}
+		return policy, nil
+	case 1:
+		return ids[0], nil
+	}
+	return "", fmt.Errorf("escalation policy name %s is ambiguous, it matches %s; use the escalation policy ID instead", policy, strings.Join(ids, ", "))
+}
+
+// pdShiftEndHorizon is how far past the end of the window shifts are looked
+// up, so that the ends of shifts starting within it aren't clipped.
+const pdShiftEndHorizon = 30 * 24 * time.Hour
+
+// getPagerdutyShifts returns the shifts on a schedule, or at the selected
+// levels of an escalation policy if ep is set, that start between from and
+// until.
+//
+// PagerDuty clips shifts to the query window, so both lookups start it a
+// moment early to tell shifts starting at from apart from ones already
+// underway, and end it well after until so shifts starting in time keep
+// their end.
+func getPagerdutyShifts(ctx context.Context, pdClient *pagerduty.Client, schedule string, ep *pdEscalationPolicy, from time.Time, until time.Time) ([]onCallShift, error) {
+	if ep != nil {
+		return getPagerdutyEscalationShifts(ctx, pdClient, schedule, *ep, from, until)
+	}
+	return getPagerdutyScheduleShifts(ctx, pdClient, schedule, from, until)
+}
+
+// getPagerdutyScheduleShifts reads shifts off a schedule's final layer, which
+// has overrides applied.
+func getPagerdutyScheduleShifts(ctx context.Context, pdClient *pagerduty.Client, schedule string, from time.Time, until time.Time) ([]onCallShift, error) {
+	scheduleID, err := pagerdutyScheduleID(ctx, pdClient, schedule)
+	if err != nil {
+		return nil, err
+	}
+	queryUntil := until.Add(pdShiftEndHorizon)
+	sch, err := pdClient.GetScheduleWithContext(ctx, scheduleID, pagerduty.GetScheduleOptions{
+		Since: from.Add(-time.Second).Format("2006-01-02T15:04:05Z07:00"),
+		Until: queryUntil.Format("2006-01-02T15:04:05Z07:00"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to GetSchedule: %s", err)
+	}
+
+	// Entries only name their user, so look each one's email up once
+	emails := map[string]string{}
+	var shifts []onCallShift
+	for _, entry := range sch.FinalSchedule.RenderedScheduleEntries {
+		start, ok := pagerdutyShiftStart(entry.Start, from, until)
+		if !ok || entry.User.ID == "" {
+			continue
+		}
+		email, ok := emails[entry.User.ID]
+		if !ok {
+			user, err := pdClient.GetUserWithContext(ctx, entry.User.ID, pagerduty.GetUserOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("unable to GetUser %s: %s", entry.User.ID, err)
+			}
+			email = user.Email
+			emails[entry.User.ID] = email
+		}
+		shift := onCallShift{
+			Email:    email,
+			Schedule: schedule,
+			Start:    start,
+			URL:      sch.HTMLURL,
+		}
+		// An end at the edge of the query was clipped, so it's unknown
+		if end, err := time.Parse(time.RFC3339, entry.End); err == nil && end.Before(queryUntil) {
+			shift.End = end
+		}
+		shifts = append(shifts, shift)
+	}
+	return shifts, nil
+}
+
+// getPagerdutyEscalationShifts reads shifts at the selected levels of an
+// escalation policy from the /oncalls endpoint.
+func getPagerdutyEscalationShifts(ctx context.Context, pdClient *pagerduty.Client, name string, ep pdEscalationPolicy, from time.Time, until time.Time) ([]onCallShift, error) {
+	policyID, err := pagerdutyEscalationPolicyID(ctx, pdClient, ep.Policy)
+	if err != nil {
+		return nil, err
+	}
+	queryUntil := until.Add(pdShiftEndHorizon)
+	onCallOpts := pagerduty.ListOnCallOptions{
+		Limit:               100,
+		Includes:            []string{"users"},
+		EscalationPolicyIDs: []string{policyID},
+		Since:               from.Add(-time.Second).Format("2006-01-02T15:04:05Z07:00"),
+		Until:               queryUntil.Format("2006-01-02T15:04:05Z07:00"),
+	}
+
+	var shifts []onCallShift
+	// Someone on call at more than one level shows up once for each
+	seen := map[string]bool{}
+	for {
+		resp, err := pdClient.ListOnCallsWithContext(ctx, onCallOpts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to ListOnCalls: %s", err)
+		}
+		for _, oncall := range resp.OnCalls {
+			if len(ep.Levels) > 0 && !slices.Contains(ep.Levels, oncall.EscalationLevel) {
+				continue
+			}
+			start, ok := pagerdutyShiftStart(oncall.Start, from, until)
+			if !ok {
+				continue
+			}
+			shift := onCallShift{
+				Email:    oncall.User.Email,
+				Schedule: name,
+				Start:    start,
+				URL:      oncall.Schedule.HTMLURL,
+			}
+			if shift.URL == "" {
+				shift.URL = oncall.EscalationPolicy.HTMLURL
+			}
+			// An end at the edge of the query was clipped, so it's unknown
+			if end, err := time.Parse(time.RFC3339, oncall.End); err == nil && end.Before(queryUntil) {
+				shift.End = end
+			}
+			key := shift.Email + "\x00" + oncall.Start
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			shifts = append(shifts, shift)
+		}
+		if !resp.More {
+			break
+		}
+		onCallOpts.Offset += onCallOpts.Limit
+	}
+	return shifts, nil
+}
+
+// pagerdutyShiftStart parses the start of an on-call, reporting whether it
+// falls between from and until. On-calls already underway at from are left
+// out, as are starts that don't parse.
+func pagerdutyShiftStart(value string, from time.Time, until time.Time) (time.Time, bool) {
+	start, err := time.Parse(time.RFC3339, value)
+	if err != nil || start.Before(from) || !start.Before(until) {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+// getPagerdutyIncidents returns the triggered and acknowledged incidents
+// assigned to the user with the given email.
+func getPagerdutyIncidents(ctx context.Context, pdClient *pagerduty.Client, email string) ([]openIncident, error) {
+	users, err := pdClient.ListUsersWithContext(ctx, pagerduty.ListUsersOptions{Query: email})
+	if err != nil {
+		return nil, fmt.Errorf("unable to ListUsers: %s", err)
+	}
+	userID := ""
+	for _, u := range users.Users {
+		if strings.EqualFold(u.Email, email) {
+			userID = u.ID
+		}
+	}
+	if userID == "" {
+		return nil, fmt.Errorf("no PagerDuty user with email %s", email)
+	}
+
+	opts := pagerduty.ListIncidentsOptions{
+		Limit:    100,
+		Statuses: []string{"triggered", "acknowledged"},
+		UserIDs:  []string{userID},
+	}
+	var incidents []openIncident
+	for {
+		resp, err := pdClient.ListIncidentsWithContext(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to ListIncidents: %s", err)
+		}
+		for _, i := range resp.Incidents {
+			incidents = append(incidents, openIncident{Number: i.IncidentNumber, Title: i.Title, URL: i.HTMLURL})
+		}
+		if !resp.More {
+			break
+		}
+		opts.Offset += opts.Limit
+	}
+	return incidents, nil
+}
+
+// pagerdutyNotFound reports whether err is PagerDuty saying there's no such
+// object.
+func pagerdutyNotFound(err error) bool {
+	var apiErr pagerduty.APIError
+	return errors.As(err, &apiErr) && apiErr.NotFound()
 }
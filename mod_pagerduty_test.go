@@ -0,0 +1,404 @@
+// mod_pagerduty_test.go - tests for the PagerDuty source
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PagerDuty/go-pagerduty"
+)
+
+// fakePagerDuty is just enough of the PagerDuty API for the PagerDuty source.
+type fakePagerDuty struct {
+	policies  []pagerduty.EscalationPolicy
+	oncalls   []pagerduty.OnCall
+	schedules []pagerduty.Schedule
+	// users on call by schedule ID
+	users map[string][]pagerduty.User
+	// incidents by assigned user ID
+	incidents map[string][]pagerduty.Incident
+	accounts  []pagerduty.User
+}
+
+func (f *fakePagerDuty) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/schedules":
+		// Like PagerDuty, match loosely and page through the results
+		var schedules []pagerduty.Schedule
+		for _, sch := range f.schedules {
+			if strings.Contains(strings.ToLower(sch.Name), strings.ToLower(r.URL.Query().Get("query"))) {
+				schedules = append(schedules, sch)
+			}
+		}
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		end := min(offset+limit, len(schedules))
+		json.NewEncoder(w).Encode(pagerduty.ListSchedulesResponse{
+			APIListObject: pagerduty.APIListObject{More: end < len(schedules)},
+			Schedules:     schedules[min(offset, end):end],
+		})
+		return
+	case strings.HasPrefix(r.URL.Path, "/schedules/") && strings.HasSuffix(r.URL.Path, "/users"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/schedules/"), "/users")
+		json.NewEncoder(w).Encode(map[string]any{"users": f.users[id]})
+		return
+	case strings.HasPrefix(r.URL.Path, "/schedules/"):
+		for _, sch := range f.schedules {
+			if sch.ID == strings.TrimPrefix(r.URL.Path, "/schedules/") {
+				json.NewEncoder(w).Encode(map[string]any{"schedule": sch})
+				return
+			}
+		}
+		http.NotFound(w, r)
+		return
+	case strings.HasPrefix(r.URL.Path, "/users/"):
+		for _, u := range f.accounts {
+			if u.ID == strings.TrimPrefix(r.URL.Path, "/users/") {
+				json.NewEncoder(w).Encode(map[string]any{"user": u})
+				return
+			}
+		}
+		http.NotFound(w, r)
+		return
+	case strings.HasPrefix(r.URL.Path, "/escalation_policies/"):
+		for _, ep := range f.policies {
+			if ep.ID == strings.TrimPrefix(r.URL.Path, "/escalation_policies/") {
+				json.NewEncoder(w).Encode(map[string]any{"escalation_policy": ep})
+				return
+			}
+		}
+		http.NotFound(w, r)
+		return
+	}
+	switch r.URL.Path {
+	case "/escalation_policies":
+		var policies []pagerduty.EscalationPolicy
+		for _, ep := range f.policies {
+			if r.URL.Query().Get("query") == "" || r.URL.Query().Get("query") == ep.Name {
+				policies = append(policies, ep)
+			}
+		}
+		json.NewEncoder(w).Encode(pagerduty.ListEscalationPoliciesResponse{EscalationPolicies: policies})
+	case "/users":
+		json.NewEncoder(w).Encode(pagerduty.ListUsersResponse{Users: f.accounts})
+	case "/incidents":
+		var incidents []pagerduty.Incident
+		for _, id := range r.URL.Query()["user_ids[]"] {
+			incidents = append(incidents, f.incidents[id]...)
+		}
+		json.NewEncoder(w).Encode(pagerduty.ListIncidentsResponse{Incidents: incidents})
+	case "/oncalls":
+		var oncalls []pagerduty.OnCall
+		for _, oc := range f.oncalls {
+			if contains(r.URL.Query()["escalation_policy_ids[]"], oc.EscalationPolicy.ID) {
+				oncalls = append(oncalls, oc)
+			}
+		}
+		json.NewEncoder(w).Encode(pagerduty.ListOnCallsResponse{OnCalls: oncalls})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newFakePagerDuty serves f and returns a client that talks to it.
+func newFakePagerDuty(t *testing.T, f *fakePagerDuty) *pagerduty.Client {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return pagerduty.NewClient("token", pagerduty.WithAPIEndpoint(srv.URL))
+}
+
+func TestPagerdutyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *deputizePDConfig
+		wantErr bool
+	}{
+		{"schedules", &deputizePDConfig{OnCallSchedules: []string{"Primary"}}, false},
+		{"escalation policy", &deputizePDConfig{EscalationPolicies: []pdEscalationPolicy{{Name: "Ops", Policy: "PABC123", Levels: []uint{1}}}}, false},
+		{"nothing on call", &deputizePDConfig{}, true},
+		{"escalation policy without a name", &deputizePDConfig{EscalationPolicies: []pdEscalationPolicy{{Policy: "PABC123"}}}, true},
+		{"escalation policy without a policy", &deputizePDConfig{EscalationPolicies: []pdEscalationPolicy{{Name: "Ops"}}}, true},
+		{"level 0", &deputizePDConfig{EscalationPolicies: []pdEscalationPolicy{{Name: "Ops", Policy: "PABC123", Levels: []uint{0}}}}, true},
+		{"name used by a schedule", &deputizePDConfig{OnCallSchedules: []string{"Ops"}, EscalationPolicies: []pdEscalationPolicy{{Name: "Ops", Policy: "PABC123"}}}, true},
+		{"OAuth without a secret", &deputizePDConfig{OnCallSchedules: []string{"Primary"}, WithOAuth: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.cfg.Validate()
+			if (len(errs) > 0) != tt.wantErr {
+				t.Errorf("Validate() = %q, wantErr %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPagerdutyWindow(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		window onCallWindow
+		since  string
+		until  string
+	}{
+		{"now", onCallWindow{}, "2024-03-01T12:00:00Z", "2024-03-01T12:00:01Z"},
+		{"lead time", onCallWindow{LeadTime: 15 * time.Minute}, "2024-03-01T12:00:00Z", "2024-03-01T12:15:00Z"},
+		{"grace period", onCallWindow{GracePeriod: 30 * time.Minute}, "2024-03-01T11:30:00Z", "2024-03-01T12:00:01Z"},
+		{"both", onCallWindow{LeadTime: time.Hour, GracePeriod: time.Hour}, "2024-03-01T11:00:00Z", "2024-03-01T13:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			since, until := pagerdutyWindow(at, tt.window)
+			if since != tt.since || until != tt.until {
+				t.Errorf("pagerdutyWindow() = %s, %s, want %s, %s", since, until, tt.since, tt.until)
+			}
+		})
+	}
+}
+
+func TestPagerdutySchedules(t *testing.T) {
+	cfg := deputizePDConfig{
+		OnCallSchedules:    []string{"Primary"},
+		EscalationPolicies: []pdEscalationPolicy{{Name: "Ops", Policy: "PABC123"}},
+	}
+	if got, want := cfg.Schedules(), []string{"Primary", "Ops"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Schedules() = %q, want %q", got, want)
+	}
+}
+
+func TestGetPagerdutyEscalationInfo(t *testing.T) {
+	f := &fakePagerDuty{
+		policies: []pagerduty.EscalationPolicy{
+			{APIObject: pagerduty.APIObject{ID: "PEP0001"}, Name: "Ops"},
+			{APIObject: pagerduty.APIObject{ID: "PEP0002"}, Name: "Ops"},
+			{APIObject: pagerduty.APIObject{ID: "PEP0003"}, Name: "Database"},
+		},
+		oncalls: []pagerduty.OnCall{
+			{User: pagerduty.User{Email: "alice@example.com"}, EscalationPolicy: pagerduty.EscalationPolicy{APIObject: pagerduty.APIObject{ID: "PEP0003"}}, EscalationLevel: 1},
+			{User: pagerduty.User{Email: "bob@example.com"}, EscalationPolicy: pagerduty.EscalationPolicy{APIObject: pagerduty.APIObject{ID: "PEP0003"}}, EscalationLevel: 2},
+			{User: pagerduty.User{Email: "alice@example.com"}, EscalationPolicy: pagerduty.EscalationPolicy{APIObject: pagerduty.APIObject{ID: "PEP0003"}}, EscalationLevel: 3},
+			{User: pagerduty.User{Email: "carol@example.com"}, EscalationPolicy: pagerduty.EscalationPolicy{APIObject: pagerduty.APIObject{ID: "PEP0001"}}, EscalationLevel: 1},
+		},
+	}
+	client := newFakePagerDuty(t, f)
+	tests := []struct {
+		name    string
+		ep      pdEscalationPolicy
+		want    []string
+		wantErr bool
+	}{
+		{"every level", pdEscalationPolicy{Name: "DB", Policy: "Database"}, []string{"alice@example.com", "bob@example.com"}, false},
+		{"primary only", pdEscalationPolicy{Name: "DB", Policy: "Database", Levels: []uint{1}}, []string{"alice@example.com"}, false},
+		{"by ID", pdEscalationPolicy{Name: "Ops", Policy: "PEP0001"}, []string{"carol@example.com"}, false},
+		{"ambiguous name", pdEscalationPolicy{Name: "Ops", Policy: "Ops"}, nil, true},
+		{"unknown name", pdEscalationPolicy{Name: "Web", Policy: "Web"}, nil, true},
+		{"unknown ID", pdEscalationPolicy{Name: "Web", Policy: "PEP0009"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getPagerdutyEscalationInfo(context.Background(), client, tt.ep, time.Now(), onCallWindow{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getPagerdutyEscalationInfo() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPagerdutyScheduleID(t *testing.T) {
+	f := &fakePagerDuty{
+		schedules: []pagerduty.Schedule{
+			{APIObject: pagerduty.APIObject{ID: "PSCH001"}, Name: "Primary Backup"},
+			{APIObject: pagerduty.APIObject{ID: "PSCH003"}, Name: "Ops"},
+			{APIObject: pagerduty.APIObject{ID: "PSCH004"}, Name: "Ops"},
+		},
+	}
+	// Put the exact match past the first page of fuzzy matches
+	for i := 0; i < 150; i++ {
+		f.schedules = append(f.schedules, pagerduty.Schedule{APIObject: pagerduty.APIObject{ID: "PFILL" + strconv.Itoa(i)}, Name: "Primary " + strconv.Itoa(i)})
+	}
+	f.schedules = append(f.schedules,
+		pagerduty.Schedule{APIObject: pagerduty.APIObject{ID: "PSCH002"}, Name: "Primary"},
+		pagerduty.Schedule{APIObject: pagerduty.APIObject{ID: "PSCH005"}, Name: "PRIMARY"},
+	)
+	client := newFakePagerDuty(t, f)
+	tests := []struct {
+		name     string
+		schedule string
+		want     string
+		wantErr  bool
+	}{
+		{"ID", "PSCH003", "PSCH003", false},
+		{"exact name on a later page", "Primary", "PSCH002", false},
+		{"name that looks like an ID", "PRIMARY", "PSCH005", false},
+		{"unknown ID", "PABC123", "", true},
+		{"ambiguous name", "Ops", "", true},
+		{"unknown name", "Database", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pagerdutyScheduleID(context.Background(), client, tt.schedule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("pagerdutyScheduleID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetPagerdutyInfo(t *testing.T) {
+	f := &fakePagerDuty{
+		schedules: []pagerduty.Schedule{
+			{APIObject: pagerduty.APIObject{ID: "PSCH001"}, Name: "Primary Backup"},
+			{APIObject: pagerduty.APIObject{ID: "PSCH002"}, Name: "Primary"},
+		},
+		users: map[string][]pagerduty.User{
+			"PSCH001": {{Email: "bob@example.com"}},
+			"PSCH002": {{Email: "alice@example.com"}},
+		},
+	}
+	client := newFakePagerDuty(t, f)
+	got, err := getPagerdutyInfo(context.Background(), client, []string{"Primary"}, time.Now(), onCallWindow{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("getPagerdutyInfo() = %q, want %q", got, want)
+	}
+}
+
+func TestPagerdutyShiftStart(t *testing.T) {
+	from := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	until := from.Add(5 * time.Minute)
+	tests := []struct {
+		name  string
+		start string
+		want  bool
+	}{
+		{"at from", "2024-03-01T12:00:00Z", true},
+		{"within", "2024-03-01T12:03:00Z", true},
+		{"other timezone", "2024-03-01T07:03:00-05:00", true},
+		{"already underway", "2024-03-01T11:59:59Z", false},
+		{"at until", "2024-03-01T12:05:00Z", false},
+		{"after until", "2024-03-02T12:00:00Z", false},
+		{"unparseable", "soon", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, ok := pagerdutyShiftStart(tt.start, from, until)
+			if ok != tt.want {
+				t.Fatalf("pagerdutyShiftStart(%s) ok = %v, want %v", tt.start, ok, tt.want)
+			}
+			if ok && (start.Before(from) || !start.Before(until)) {
+				t.Errorf("pagerdutyShiftStart(%s) = %s, outside the window", tt.start, start)
+			}
+		})
+	}
+}
+
+func TestGetPagerdutyShifts(t *testing.T) {
+	from := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	until := from.Add(5 * time.Minute)
+	// PagerDuty clips the last entry to the end of the query
+	clipped := until.Add(pdShiftEndHorizon).Format(time.RFC3339)
+	entry := func(start string, end string, user string) pagerduty.RenderedScheduleEntry {
+		return pagerduty.RenderedScheduleEntry{Start: start, End: end, User: pagerduty.APIObject{ID: user}}
+	}
+	f := &fakePagerDuty{
+		schedules: []pagerduty.Schedule{{
+			APIObject: pagerduty.APIObject{ID: "PSCH001", HTMLURL: "https://example.pagerduty.com/schedules/PSCH001"},
+			Name:      "Primary",
+			FinalSchedule: pagerduty.ScheduleLayer{RenderedScheduleEntries: []pagerduty.RenderedScheduleEntry{
+				entry("2024-03-01T11:59:59Z", "2024-03-01T12:02:00Z", "PUSER01"),
+				entry("2024-03-01T12:02:00Z", "2024-03-01T12:04:00Z", "PUSER02"),
+				entry("2024-03-01T12:04:00Z", clipped, "PUSER01"),
+			}},
+		}},
+		accounts: []pagerduty.User{
+			{APIObject: pagerduty.APIObject{ID: "PUSER01"}, Email: "alice@example.com"},
+			{APIObject: pagerduty.APIObject{ID: "PUSER02"}, Email: "bob@example.com"},
+		},
+		policies: []pagerduty.EscalationPolicy{{APIObject: pagerduty.APIObject{ID: "PEP0001"}, Name: "Ops"}},
+		oncalls: []pagerduty.OnCall{
+			{User: pagerduty.User{Email: "carol@example.com"}, EscalationPolicy: pagerduty.EscalationPolicy{APIObject: pagerduty.APIObject{ID: "PEP0001", HTMLURL: "https://example.pagerduty.com/escalation_policies/PEP0001"}}, EscalationLevel: 1, Start: "2024-03-01T12:01:00Z", End: clipped},
+			{User: pagerduty.User{Email: "dave@example.com"}, EscalationPolicy: pagerduty.EscalationPolicy{APIObject: pagerduty.APIObject{ID: "PEP0001"}}, EscalationLevel: 2, Start: "2024-03-01T12:01:00Z"},
+		},
+	}
+	client := newFakePagerDuty(t, f)
+
+	got, err := getPagerdutyShifts(context.Background(), client, "Primary", nil, from, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []onCallShift{{
+		Email:    "bob@example.com",
+		Schedule: "Primary",
+		Start:    time.Date(2024, 3, 1, 12, 2, 0, 0, time.UTC),
+		End:      time.Date(2024, 3, 1, 12, 4, 0, 0, time.UTC),
+		URL:      "https://example.pagerduty.com/schedules/PSCH001",
+	}, {
+		Email:    "alice@example.com",
+		Schedule: "Primary",
+		Start:    time.Date(2024, 3, 1, 12, 4, 0, 0, time.UTC),
+		URL:      "https://example.pagerduty.com/schedules/PSCH001",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("schedule shifts = %+v, want %+v", got, want)
+	}
+
+	got, err = getPagerdutyShifts(context.Background(), client, "Ops primary", &pdEscalationPolicy{Name: "Ops primary", Policy: "Ops", Levels: []uint{1}}, from, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []onCallShift{{
+		Email:    "carol@example.com",
+		Schedule: "Ops primary",
+		Start:    time.Date(2024, 3, 1, 12, 1, 0, 0, time.UTC),
+		URL:      "https://example.pagerduty.com/escalation_policies/PEP0001",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("escalation policy shifts = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetPagerdutyIncidents(t *testing.T) {
+	f := &fakePagerDuty{
+		accounts: []pagerduty.User{
+			{APIObject: pagerduty.APIObject{ID: "PUSER01"}, Email: "alice@example.com.au"},
+			{APIObject: pagerduty.APIObject{ID: "PUSER02"}, Email: "Alice@example.com"},
+		},
+		incidents: map[string][]pagerduty.Incident{
+			"PUSER02": {{IncidentNumber: 42, Title: "Disk full", APIObject: pagerduty.APIObject{HTMLURL: "https://example.pagerduty.com/incidents/P42"}}},
+		},
+	}
+	client := newFakePagerDuty(t, f)
+	got, err := getPagerdutyIncidents(context.Background(), client, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []openIncident{{Number: 42, Title: "Disk full", URL: "https://example.pagerduty.com/incidents/P42"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getPagerdutyIncidents() = %+v, want %+v", got, want)
+	}
+	if _, err := getPagerdutyIncidents(context.Background(), client, "bob@example.com"); err == nil {
+		t.Error("getPagerdutyIncidents() for an unknown user succeeded, want an error")
+	}
+}
@@ -5,37 +5,183 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"reflect"
 	"regexp"
 	"strings"
+	"time"
+	// Lambda doesn't ship timezone data, and we need it for reminders
+	_ "time/tzdata"
 
 	"github.com/slack-go/slack"
 )
 
-func updateSlack(cfg deputizeSlackConfig, pdOnCallEmails []string, slackAuthToken string) error {
+type deputizeSlackConfig struct {
+	Channels    []slackChannel
+	Enabled     bool
+	PostMessage bool
+	// Handoff posts a handoff message when the people on call change, saying
+	// who's going off and coming on call, which schedules changed and what
+	// incidents the outgoing people still have open, with a thread for them
+	// to leave notes in. It replaces PostMessage's plain message.
+	Handoff bool
+	// Schedules feed the channels and user group. Leave empty to use every
+	// source schedule.
+	Schedules []string
+	// UserGroup is the ID (S0123ABCD) or handle (@ops-oncall) of a user group
+	// to keep in sync with who's on call.
+	UserGroup string
+	// Reminders tell people their shift is coming up.
+	Reminders *slackReminders
+}
+
+// slackReminders sends reminders a while before people's shifts start.
+// Deputize doesn't keep track of what it's sent, so each run reminds people
+// whose shifts start in the Window after Before from now. Set Window to how
+// often deputize runs and everyone gets one reminder.
+type slackReminders struct {
+	// Before is how long before a shift starts to send the reminder, as a Go
+	// duration ("1h").
+	Before string
+	// Window is how often deputize runs, as a Go duration; defaults to "5m".
+	Window string
+	// Channel to post reminders in. Leave empty to DM each person.
+	Channel string
+	// Schedules to send reminders for, overriding the sink's Schedules.
+	Schedules []string
+
+	// filled in by Validate
+	before time.Duration
+	window time.Duration
+}
+
+// slackChannel is a channel whose topic we keep up to date. In the config it
+// can be a plain channel ID, or an object with the schedules for the channel.
+type slackChannel struct {
+	ID string
+	// Schedules feed this channel, overriding the sink's Schedules.
+	Schedules []string
+}
+
+func (c *slackChannel) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &c.ID); err == nil {
+		return nil
+	}
+	type plain slackChannel
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+func init() {
+	registerSink("Slack", func() Sink { return &deputizeSlackConfig{} })
+}
+
+func (cfg *deputizeSlackConfig) Validate() []string {
+	var configErrors []string
+	if len(cfg.Channels) == 0 && cfg.UserGroup == "" && cfg.Reminders == nil {
+		configErrors = append(configErrors, "none of Channels, UserGroup or Reminders configured")
+	}
+	if r := cfg.Reminders; r != nil {
+		d, err := time.ParseDuration(r.Before)
+		if err != nil || d <= 0 {
+			configErrors = append(configErrors, "Reminders: Before must be a positive duration")
+		}
+		r.before = d
+		if r.Window == "" {
+			r.Window = "5m"
+		}
+		d, err = time.ParseDuration(r.Window)
+		if err != nil || d <= 0 {
+			configErrors = append(configErrors, "Reminders: Window must be a positive duration")
+		}
+		r.window = d
+		if len(r.Schedules) == 0 {
+			r.Schedules = cfg.Schedules
+		}
+	}
+	for _, c := range cfg.Channels {
+		if c.ID == "" {
+			configErrors = append(configErrors, "channel ID not configured")
+		}
+	}
+	return configErrors
+}
+
+func (cfg *deputizeSlackConfig) Secrets() []string {
+	return []string{"SlackAuthToken"}
+}
+
+func (cfg *deputizeSlackConfig) Update(ctx context.Context, run *sinkRun) ([]sinkChange, error) {
+	token := run.sec["SlackAuthToken"]
+	slackAPI, _ := cachedClient(run.clients, "slack\x00"+token, func() (*slack.Client, error) {
+		return slack.New(token), nil
+	})
+	return updateSlack(ctx, *cfg, slackAPI, run)
+}
+
+func updateSlack(ctx context.Context, cfg deputizeSlackConfig, slackAPI *slack.Client, run *sinkRun) ([]sinkChange, error) {
 	log.Printf("Beginning Slack Update.\n")
-	slackAPI := slack.New(slackAuthToken)
-	var oncallUsers []*slack.User
-	for _, email := range pdOnCallEmails {
-		user, err := slackAPI.GetUserByEmail(email)
+
+	// Channels can share schedules, so remember who we've already looked up
+	emailUIDs := map[string]string{}
+	getSlackUIDs := func(schedules []string) ([]string, error) {
+		oncallEmails, err := run.oncall(ctx, schedules)
 		if err != nil {
-			return fmt.Errorf("unable to getUserByEmail: %s", err)
+			return nil, err
+		}
+		var slackUIDs []string
+		for _, email := range oncallEmails {
+			uid, ok := emailUIDs[email]
+			if !ok {
+				uid = run.identities.lookup(email).Slack
+				ok = uid != ""
+			}
+			if !ok {
+				user, err := slackAPI.GetUserByEmailContext(ctx, email)
+				var slackErr slack.SlackErrorResponse
+				if errors.As(err, &slackErr) && slackErr.Err == "users_not_found" {
+					fallback, err := run.unresolvedUser(email)
+					if err != nil {
+						return nil, err
+					}
+					fallbackUIDs, err := slackFallbackUIDs(ctx, slackAPI, fallback)
+					if err != nil {
+						return nil, err
+					}
+					slackUIDs = append(slackUIDs, fallbackUIDs...)
+					continue
+				}
+				if err != nil {
+					return nil, fmt.Errorf("unable to getUserByEmail: %s", err)
+				}
+				uid = user.ID
+				emailUIDs[email] = uid
+			}
+			slackUIDs = append(slackUIDs, uid)
 		}
-		oncallUsers = append(oncallUsers, user)
+		return removeDuplicates(slackUIDs), nil
 	}
 
-	var slackUIDs []string
-	for _, user := range oncallUsers {
-		slackUIDs = append(slackUIDs, user.ID)
-	}
-	log.Printf("Current Oncall UIDs: %+v\n", slackUIDs)
+	var changes []sinkChange
 
 	for _, channel := range cfg.Channels {
-		c, err := slackAPI.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: channel})
+		schedules := channel.Schedules
+		if len(schedules) == 0 {
+			schedules = cfg.Schedules
+		}
+		slackUIDs, err := getSlackUIDs(schedules)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Current Oncall UIDs for channel %s: %+v\n", channel.ID, slackUIDs)
+
+		c, err := slackAPI.GetConversationInfoContext(ctx, &slack.GetConversationInfoInput{ChannelID: channel.ID})
 		if err != nil {
 			log.Printf("Warning: Got %s back from Slack API\n", err)
+			continue
 		}
 
 		// Does the channel topic have a | in it? that's our delimiter, attempt to split.
@@ -45,10 +191,11 @@ func updateSlack(cfg deputizeSlackConfig, pdOnCallEmails []string, slackAuthToke
 		r, _ := regexp.Compile("U[A-Z0-9]+")
 		topicUIDs := r.FindAllString(channelTopic[0], -1)
 
-		log.Printf("Oncall UIDs from channel %s: %+v\n", channel, topicUIDs)
+		log.Printf("Oncall UIDs from channel %s: %+v\n", channel.ID, topicUIDs)
 
-		// See if they match w/ current on call, if not then update topic
-		if !reflect.DeepEqual(slackUIDs, topicUIDs) {
+		// See if they match w/ current on call, if not then update topic.
+		// Nobody on call and nobody in the topic match, empty or nil.
+		if len(slackUIDs)+len(topicUIDs) > 0 && !reflect.DeepEqual(slackUIDs, topicUIDs) {
 			log.Printf("Difference between Current and Topic UIDs, updating topic.\n")
 			topic := "On-Call: "
 			// slackify the UIDs
@@ -59,27 +206,300 @@ func updateSlack(cfg deputizeSlackConfig, pdOnCallEmails []string, slackAuthToke
 				}
 
 			}
+			newTopic := fmt.Sprintf("%s |", topic)
 			if len(channelTopic) > 1 {
-				_, err := slackAPI.SetTopicOfConversation(channel, fmt.Sprintf("%s |%s", topic, strings.Join(channelTopic[1:], "|")))
-				if err != nil {
-					log.Printf("Warning: Got %s back from Slack API\n", err)
-				}
-			} else {
-				_, err := slackAPI.SetTopicOfConversation(channel, fmt.Sprintf("%s |", topic))
+				newTopic = fmt.Sprintf("%s |%s", topic, strings.Join(channelTopic[1:], "|"))
+			}
+			change := sinkChange{
+				Target: channel.ID,
+				Add:    difference(slackUIDs, topicUIDs),
+				Remove: difference(topicUIDs, slackUIDs),
+				Topic:  newTopic,
+			}
+			var handoffNotes string
+			switch {
+			case cfg.Handoff:
+				change.Message, handoffNotes, err = slackHandoff(ctx, slackAPI, run, schedules, change.Remove, change.Add, c.Topic.LastSet.Time())
 				if err != nil {
-					log.Printf("Warning: Got %s back from Slack API\n", err)
+					return nil, err
 				}
+			case cfg.PostMessage:
+				change.Message = topic
+			}
+			changes = append(changes, change)
+			if run.dryRun {
+				log.Printf("Dry run, not updating channel %s\n", channel.ID)
+				continue
+			}
+
+			_, err := slackAPI.SetTopicOfConversationContext(ctx, channel.ID, newTopic)
+			if err != nil {
+				log.Printf("Warning: Got %s back from Slack API\n", err)
 			}
-			if cfg.PostMessage {
+			if change.Message != "" {
 				slackParams := slack.PostMessageParameters{}
 				slackParams.AsUser = true
-				_, _, err := slackAPI.PostMessage(channel, slack.MsgOptionPostMessageParameters(slackParams), slack.MsgOptionText(topic, false))
+				_, ts, err := slackAPI.PostMessageContext(ctx, channel.ID, slack.MsgOptionPostMessageParameters(slackParams), slack.MsgOptionText(change.Message, false))
 				if err != nil {
 					log.Printf("Warning: Got %s back from Slack API\n", err)
+				} else if handoffNotes != "" {
+					_, _, err := slackAPI.PostMessageContext(ctx, channel.ID, slack.MsgOptionPostMessageParameters(slackParams), slack.MsgOptionTS(ts), slack.MsgOptionText(handoffNotes, false))
+					if err != nil {
+						log.Printf("Warning: Got %s back from Slack API\n", err)
+					}
 				}
 			}
 		}
 	}
+
+	if cfg.UserGroup != "" {
+		slackUIDs, err := getSlackUIDs(cfg.Schedules)
+		if err != nil {
+			return nil, err
+		}
+		change, err := updateSlackUserGroup(ctx, slackAPI, cfg.UserGroup, slackUIDs, run.dryRun)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+
+	if cfg.Reminders != nil {
+		reminders, err := sendSlackReminders(ctx, *cfg.Reminders, slackAPI, run)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, reminders...)
+	}
+
 	log.Printf("Slack update complete.\n")
-	return nil
+	return changes, nil
+}
+
+// slackHandoff builds the handoff message for a channel whose on-call people
+// have changed, along with the prompt for the outgoing people to leave notes
+// in its thread (empty if nobody's going off call). lastSet is when the
+// channel topic was last set, which is when the outgoing people came in.
+func slackHandoff(ctx context.Context, slackAPI *slack.Client, run *sinkRun, schedules []string, outgoing []string, incoming []string, lastSet time.Time) (string, string, error) {
+	lines := []string{"*On-call handoff*"}
+	if len(outgoing) > 0 {
+		lines = append(lines, "Going off call: "+slackMentions(outgoing))
+	}
+	if len(incoming) > 0 {
+		lines = append(lines, "Coming on call: "+slackMentions(incoming))
+	}
+
+	// A schedule has changed if who's on call for it now differs from who
+	// was when the topic was last set. A topic that's never been set had
+	// nobody on call.
+	names, err := run.schedules(schedules)
+	if err != nil {
+		return "", "", err
+	}
+	var changed []string
+	for _, name := range names {
+		current, err := run.oncall(ctx, []string{name})
+		if err != nil {
+			return "", "", err
+		}
+		var previous []string
+		if lastSet.Unix() > 0 {
+			previous, err = run.oncallAt(ctx, []string{name}, lastSet)
+			if err != nil {
+				log.Printf("Warning: unable to find who was on call for %s, not listing changed schedules: %s\n", name, err)
+				changed = nil
+				break
+			}
+		}
+		if len(differenceFold(current, previous)) > 0 || len(differenceFold(previous, current)) > 0 {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		lines = append(lines, "Schedules changed: "+strings.Join(changed, ", "))
+	}
+
+	for _, uid := range outgoing {
+		email, err := slackUserEmail(ctx, slackAPI, run, uid)
+		if err != nil {
+			log.Printf("Warning: unable to find email for %s, not listing their incidents: %s\n", uid, err)
+			continue
+		}
+		incidents, _ := run.incidents(ctx, email)
+		if len(incidents) == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("Open incidents assigned to <@%s>:", uid))
+		for _, i := range incidents {
+			lines = append(lines, fmt.Sprintf("• <%s|#%d %s>", i.URL, i.Number, i.Title))
+		}
+	}
+
+	var notes string
+	if len(outgoing) > 0 {
+		notes = fmt.Sprintf("%s, please leave handoff notes in this thread: anything in progress, anything to watch out for.", slackMentions(outgoing))
+	}
+	return strings.Join(lines, "\n"), notes, nil
+}
+
+// slackUserEmail returns the on-call email of a Slack user, from the identity
+// mapping if they're in it, otherwise their Slack profile.
+func slackUserEmail(ctx context.Context, slackAPI *slack.Client, run *sinkRun, uid string) (string, error) {
+	for email, id := range run.identities {
+		if id.Slack == uid {
+			return email, nil
+		}
+	}
+	user, err := slackAPI.GetUserInfoContext(ctx, uid)
+	if err != nil {
+		return "", err
+	}
+	if user.Profile.Email == "" {
+		return "", fmt.Errorf("no email in Slack profile")
+	}
+	return user.Profile.Email, nil
+}
+
+// slackFallbackUIDs turns fallback users into UIDs. A fallback can be a user
+// ID, or a user group ID (S0123ABCD) standing for everyone in the group.
+func slackFallbackUIDs(ctx context.Context, slackAPI *slack.Client, fallback []string) ([]string, error) {
+	var uids []string
+	for _, id := range fallback {
+		if !slackUserGroupIDRegexp.MatchString(id) {
+			uids = append(uids, id)
+			continue
+		}
+		members, err := slackAPI.GetUserGroupMembersContext(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get members of fallback user group %s: %s", id, err)
+		}
+		uids = append(uids, members...)
+	}
+	return uids, nil
+}
+
+// slackMentions formats UIDs as a list of mentions.
+func slackMentions(uids []string) string {
+	var mentions []string
+	for _, uid := range uids {
+		mentions = append(mentions, "<@"+uid+">")
+	}
+	return strings.Join(mentions, ", ")
+}
+
+var slackUserGroupIDRegexp = regexp.MustCompile("^S[A-Z0-9]+$")
+
+// updateSlackUserGroup makes the members of a user group match slackUIDs.
+func updateSlackUserGroup(ctx context.Context, slackAPI *slack.Client, userGroup string, slackUIDs []string, dryRun bool) (*sinkChange, error) {
+	groupID := userGroup
+	if !slackUserGroupIDRegexp.MatchString(userGroup) {
+		// Look the group up by its handle
+		handle := strings.TrimPrefix(userGroup, "@")
+		groups, err := slackAPI.GetUserGroupsContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get user groups: %s", err)
+		}
+		groupID = ""
+		for _, g := range groups {
+			if g.Handle == handle {
+				groupID = g.ID
+			}
+		}
+		if groupID == "" {
+			return nil, fmt.Errorf("no user group found with handle %s", userGroup)
+		}
+	}
+
+	currentUIDs, err := slackAPI.GetUserGroupMembersContext(ctx, groupID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get members of user group %s: %s", userGroup, err)
+	}
+	log.Printf("Oncall UIDs from user group %s: %+v\n", userGroup, currentUIDs)
+
+	add := difference(slackUIDs, currentUIDs)
+	remove := difference(currentUIDs, slackUIDs)
+	if len(add) == 0 && len(remove) == 0 {
+		return nil, nil
+	}
+	if len(slackUIDs) == 0 {
+		// Slack won't let a user group be emptied, so leave it alone
+		log.Printf("No on-call users, not updating user group %s\n", userGroup)
+		return nil, nil
+	}
+
+	change := &sinkChange{Target: userGroup, Add: add, Remove: remove}
+	if dryRun {
+		log.Printf("Dry run, not updating user group %s\n", userGroup)
+		return change, nil
+	}
+	log.Printf("Difference between Current and user group UIDs, updating user group %s.\n", userGroup)
+	if _, err := slackAPI.UpdateUserGroupMembersContext(ctx, groupID, strings.Join(slackUIDs, ",")); err != nil {
+		return nil, fmt.Errorf("unable to update user group %s: %s", userGroup, err)
+	}
+	return change, nil
+}
+
+// sendSlackReminders reminds people whose shifts start soon, by DM or in the
+// reminder channel. Times are given in each person's own Slack timezone.
+func sendSlackReminders(ctx context.Context, cfg slackReminders, slackAPI *slack.Client, run *sinkRun) ([]sinkChange, error) {
+	from := time.Now().Add(cfg.before)
+	shifts, err := run.shifts(ctx, cfg.Schedules, from, from.Add(cfg.window))
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []sinkChange
+	for _, shift := range shifts {
+		var user *slack.User
+		if uid := run.identities.lookup(shift.Email).Slack; uid != "" {
+			user, err = slackAPI.GetUserInfoContext(ctx, uid)
+		} else {
+			user, err = slackAPI.GetUserByEmailContext(ctx, shift.Email)
+		}
+		var slackErr slack.SlackErrorResponse
+		if errors.As(err, &slackErr) && (slackErr.Err == "users_not_found" || slackErr.Err == "user_not_found") {
+			// Reminding a fallback user about someone else's shift would just
+			// confuse them, so only a Fail policy matters here
+			if _, err := run.unresolvedUser(shift.Email); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up Slack user for %s: %s", shift.Email, err)
+		}
+
+		loc, err := time.LoadLocation(user.TZ)
+		if err != nil {
+			loc = time.UTC
+		}
+		const layout = "Mon Jan 2 3:04 PM MST"
+		when := fmt.Sprintf("starts %s", shift.Start.In(loc).Format(layout))
+		if !shift.End.IsZero() {
+			when = fmt.Sprintf("%s and ends %s", when, shift.End.In(loc).Format(layout))
+		}
+		who := "Your"
+		target := user.ID
+		if cfg.Channel != "" {
+			who = fmt.Sprintf("<@%s>'s", user.ID)
+			target = cfg.Channel
+		}
+		message := fmt.Sprintf("Reminder: %s on-call shift for %s %s.", who, shift.Schedule, when)
+		if shift.URL != "" {
+			message = fmt.Sprintf("%s <%s|View the schedule>", message, shift.URL)
+		}
+
+		changes = append(changes, sinkChange{Target: target, Message: message})
+		if run.dryRun {
+			log.Printf("Dry run, not sending shift reminder to %s\n", user.ID)
+			continue
+		}
+		log.Printf("Sending shift reminder for %s to %s\n", shift.Email, target)
+		if _, _, err := slackAPI.PostMessageContext(ctx, target, slack.MsgOptionText(message, false)); err != nil {
+			log.Printf("Warning: Got %s back from Slack API\n", err)
+		}
+	}
+	return changes, nil
 }
@@ -0,0 +1,354 @@
+// mod_slack_test.go - tests for the Slack sink
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// fakeSlack is just enough of the Slack Web API for the Slack sink.
+type fakeSlack struct {
+	mu sync.Mutex
+	// groups maps user group IDs to their handle and members
+	groups map[string]*fakeSlackGroup
+	// topics maps channel IDs to their topic
+	topics map[string]string
+	// users maps emails to user IDs
+	users map[string]string
+	// methods called that change something
+	changes []string
+}
+
+type fakeSlackGroup struct {
+	handle  string
+	members []string
+}
+
+func newFakeSlack(t *testing.T, f *fakeSlack) *slack.Client {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return slack.New("token", slack.OptionAPIURL(srv.URL+"/"))
+}
+
+func (f *fakeSlack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r.ParseForm()
+	resp := map[string]any{"ok": true}
+	switch strings.TrimPrefix(r.URL.Path, "/") {
+	case "usergroups.list":
+		var groups []map[string]string
+		for id, g := range f.groups {
+			groups = append(groups, map[string]string{"id": id, "handle": g.handle})
+		}
+		resp["usergroups"] = groups
+	case "usergroups.users.list":
+		g, ok := f.groups[r.Form.Get("usergroup")]
+		if !ok {
+			resp = map[string]any{"ok": false, "error": "no_such_subteam"}
+			break
+		}
+		resp["users"] = g.members
+	case "usergroups.users.update":
+		id := r.Form.Get("usergroup")
+		f.changes = append(f.changes, "update "+id+" "+r.Form.Get("users"))
+		f.groups[id].members = strings.Split(r.Form.Get("users"), ",")
+		resp["usergroup"] = map[string]string{"id": id}
+	case "users.lookupByEmail":
+		id, ok := f.users[r.Form.Get("email")]
+		if !ok {
+			resp = map[string]any{"ok": false, "error": "users_not_found"}
+			break
+		}
+		resp["user"] = map[string]string{"id": id}
+	case "conversations.info":
+		id := r.Form.Get("channel")
+		resp["channel"] = map[string]any{"id": id, "topic": map[string]any{"value": f.topics[id]}}
+	case "conversations.setTopic":
+		id := r.Form.Get("channel")
+		f.changes = append(f.changes, "topic "+id+" "+r.Form.Get("topic"))
+		f.topics[id] = r.Form.Get("topic")
+		resp["channel"] = map[string]any{"id": id}
+	case "chat.postMessage":
+		f.changes = append(f.changes, "post "+r.Form.Get("channel")+" "+r.Form.Get("text"))
+		resp["channel"] = r.Form.Get("channel")
+		resp["ts"] = "1700000000.000100"
+	default:
+		resp = map[string]any{"ok": false, "error": "unknown_method"}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestUpdateSlackUserGroup(t *testing.T) {
+	tests := []struct {
+		name      string
+		userGroup string
+		uids      []string
+		dryRun    bool
+		wantErr   bool
+		add       []string
+		remove    []string
+		changes   []string
+	}{
+		{
+			name:      "by ID",
+			userGroup: "S0ONCALL",
+			uids:      []string{"U0BOB", "U0CAROL"},
+			add:       []string{"U0CAROL"},
+			remove:    []string{"U0ALICE"},
+			changes:   []string{"update S0ONCALL U0BOB,U0CAROL"},
+		},
+		{
+			name:      "by handle",
+			userGroup: "@ops-oncall",
+			uids:      []string{"U0CAROL"},
+			add:       []string{"U0CAROL"},
+			remove:    []string{"U0ALICE", "U0BOB"},
+			changes:   []string{"update S0ONCALL U0CAROL"},
+		},
+		{
+			name:      "unchanged",
+			userGroup: "S0ONCALL",
+			uids:      []string{"U0BOB", "U0ALICE"},
+		},
+		{
+			name:      "dry run",
+			userGroup: "S0ONCALL",
+			uids:      []string{"U0CAROL"},
+			dryRun:    true,
+			add:       []string{"U0CAROL"},
+			remove:    []string{"U0ALICE", "U0BOB"},
+		},
+		{
+			name:      "never emptied",
+			userGroup: "S0ONCALL",
+		},
+		{
+			name:      "unknown handle",
+			userGroup: "@nope",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeSlack{groups: map[string]*fakeSlackGroup{"S0ONCALL": {handle: "ops-oncall", members: []string{"U0ALICE", "U0BOB"}}}}
+			slackAPI := newFakeSlack(t, fake)
+
+			change, err := updateSlackUserGroup(context.Background(), slackAPI, tt.userGroup, tt.uids, tt.dryRun)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			var add, remove []string
+			if change != nil {
+				add, remove = change.Add, change.Remove
+			}
+			if !reflect.DeepEqual(add, tt.add) || !reflect.DeepEqual(remove, tt.remove) {
+				t.Errorf("change add %q remove %q, want add %q remove %q", add, remove, tt.add, tt.remove)
+			}
+			if !reflect.DeepEqual(fake.changes, tt.changes) {
+				t.Errorf("Slack changes %q, want %q", fake.changes, tt.changes)
+			}
+		})
+	}
+}
+
+func TestUpdateSlackTopic(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		oncall  []string
+		changes []string
+	}{
+		{
+			name:    "handoff",
+			topic:   "On-Call: <@U0ALICE> | runbook",
+			oncall:  []string{"bob@example.com"},
+			changes: []string{"topic C0OPS On-Call: <@U0BOB> | runbook", "post C0OPS On-Call: <@U0BOB>"},
+		},
+		{
+			name:   "unchanged",
+			topic:  "On-Call: <@U0BOB> | runbook",
+			oncall: []string{"bob@example.com"},
+		},
+		{
+			name:  "nobody on call",
+			topic: "On-Call:  | runbook",
+		},
+		{
+			name:    "everyone gone off call",
+			topic:   "On-Call: <@U0ALICE> | runbook",
+			changes: []string{"topic C0OPS On-Call:  | runbook", "post C0OPS On-Call: "},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeSlack{
+				topics: map[string]string{"C0OPS": tt.topic},
+				users:  map[string]string{"alice@example.com": "U0ALICE", "bob@example.com": "U0BOB"},
+			}
+			slackAPI := newFakeSlack(t, fake)
+			cfg := deputizeSlackConfig{Channels: []slackChannel{{ID: "C0OPS"}}, PostMessage: true}
+			run := &sinkRun{lookup: func(ctx context.Context, schedules []string, window onCallWindow) ([]string, error) {
+				return tt.oncall, nil
+			}}
+
+			if _, err := updateSlack(context.Background(), cfg, slackAPI, run); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fake.changes, tt.changes) {
+				t.Errorf("Slack changes %q, want %q", fake.changes, tt.changes)
+			}
+		})
+	}
+}
+
+func TestSlackChannelUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []slackChannel
+		wantErr bool
+	}{
+		{"plain IDs", `["C0123", "C0456"]`, []slackChannel{{ID: "C0123"}, {ID: "C0456"}}, false},
+		{"objects", `[{"ID": "C0123", "Schedules": ["Ops"]}]`, []slackChannel{{ID: "C0123", Schedules: []string{"Ops"}}}, false},
+		{"mixed", `["C0123", {"ID": "C0456"}]`, []slackChannel{{ID: "C0123"}, {ID: "C0456"}}, false},
+		{"bad", `[1]`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []slackChannel
+			err := json.Unmarshal([]byte(tt.in), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlackValidateReminders(t *testing.T) {
+	tests := []struct {
+		name          string
+		reminders     *slackReminders
+		wantBefore    time.Duration
+		wantWindow    time.Duration
+		wantSchedules []string
+		wantErr       bool
+	}{
+		{"defaults", &slackReminders{Before: "1h"}, time.Hour, 5 * time.Minute, []string{"Primary"}, false},
+		{"own window and schedules", &slackReminders{Before: "30m", Window: "15m", Schedules: []string{"Secondary"}}, 30 * time.Minute, 15 * time.Minute, []string{"Secondary"}, false},
+		{"no Before", &slackReminders{}, 0, 0, nil, true},
+		{"negative Before", &slackReminders{Before: "-1h"}, 0, 0, nil, true},
+		{"bad Window", &slackReminders{Before: "1h", Window: "often"}, 0, 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := deputizeSlackConfig{Schedules: []string{"Primary"}, Reminders: tt.reminders}
+			errs := cfg.Validate()
+			if (len(errs) > 0) != tt.wantErr {
+				t.Fatalf("Validate() = %q, wantErr %v", errs, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			r := cfg.Reminders
+			if r.before != tt.wantBefore || r.window != tt.wantWindow || !reflect.DeepEqual(r.Schedules, tt.wantSchedules) {
+				t.Errorf("before %s window %s Schedules %q, want %s %s %q", r.before, r.window, r.Schedules, tt.wantBefore, tt.wantWindow, tt.wantSchedules)
+			}
+		})
+	}
+}
+
+func TestSlackMentions(t *testing.T) {
+	if got, want := slackMentions([]string{"U1", "U2"}), "<@U1>, <@U2>"; got != want {
+		t.Errorf("slackMentions() = %q, want %q", got, want)
+	}
+	if got := slackMentions(nil); got != "" {
+		t.Errorf("slackMentions(nil) = %q, want nothing", got)
+	}
+}
+
+func TestSlackHandoff(t *testing.T) {
+	lastSet := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	now := map[string][]string{"Primary": {"bob@example.com"}, "Secondary": {"carol@example.com"}}
+	then := map[string][]string{"Primary": {"alice@example.com"}, "Secondary": {"Carol@example.com"}}
+	var pastErr error
+	run := &sinkRun{
+		identities: identityMap{"alice@example.com": {Slack: "U1"}},
+		lookup: func(ctx context.Context, schedules []string, window onCallWindow) ([]string, error) {
+			return now[schedules[0]], nil
+		},
+		oncallAt: func(ctx context.Context, schedules []string, at time.Time) ([]string, error) {
+			if !at.Equal(lastSet) {
+				t.Errorf("asked who was on call at %s, want %s", at, lastSet)
+			}
+			return then[schedules[0]], pastErr
+		},
+		schedules: func(schedules []string) ([]string, error) {
+			return []string{"Primary", "Secondary"}, nil
+		},
+		incidents: func(ctx context.Context, email string) ([]openIncident, error) {
+			if email != "alice@example.com" {
+				return nil, nil
+			}
+			return []openIncident{{Number: 42, Title: "Disk full", URL: "https://example.pagerduty.com/incidents/P42"}}, nil
+		},
+	}
+	message, notes, err := slackHandoff(context.Background(), nil, run, nil, []string{"U1"}, []string{"U2"}, lastSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"*On-call handoff*",
+		"Going off call: <@U1>",
+		"Coming on call: <@U2>",
+		"Schedules changed: Primary",
+		"Open incidents assigned to <@U1>:",
+		"• <https://example.pagerduty.com/incidents/P42|#42 Disk full>",
+	}, "\n")
+	if message != want {
+		t.Errorf("message = %q, want %q", message, want)
+	}
+	if !strings.HasPrefix(notes, "<@U1>, please leave handoff notes") {
+		t.Errorf("notes = %q, want a prompt for <@U1>", notes)
+	}
+
+	// A topic that's never been set had nobody on call, so every schedule
+	// with someone on it changed, and nobody going off call means nobody to
+	// leave notes
+	message, notes, err = slackHandoff(context.Background(), nil, run, nil, nil, []string{"U2"}, time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(message, "Schedules changed: Primary, Secondary") {
+		t.Errorf("message = %q, want every schedule changed", message)
+	}
+	if notes != "" {
+		t.Errorf("notes = %q, want none", notes)
+	}
+
+	// Not knowing who was on call leaves out the changed schedules
+	pastErr = fmt.Errorf("no history")
+	message, _, err = slackHandoff(context.Background(), nil, run, nil, nil, []string{"U2"}, lastSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(message, "Schedules changed") {
+		t.Errorf("message = %q, want no changed schedules", message)
+	}
+}
@@ -0,0 +1,313 @@
+// oncall.go - on-call lookups shared by every sink
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// onCallLookup returns the emails of the people on call for schedules at any
+// point in window. A nil or empty list means every schedule configured on the
+// sources.
+type onCallLookup func(ctx context.Context, schedules []string, window onCallWindow) ([]string, error)
+
+// onCallWindow widens who counts as on call beyond this moment. The zero
+// value is just now.
+type onCallWindow struct {
+	// LeadTime adds people going on call within this long.
+	LeadTime time.Duration
+	// GracePeriod keeps people who went off call within this long.
+	GracePeriod time.Duration
+}
+
+// pastLookup returns the emails of the people on call for schedules at a time
+// in the past. A nil or empty list means every schedule configured on the
+// sources.
+type pastLookup func(ctx context.Context, schedules []string, at time.Time) ([]string, error)
+
+// onCallShift is a stretch of time someone is on call for a schedule.
+type onCallShift struct {
+	Email    string
+	Schedule string
+	Start    time.Time
+	// End is zero if the shift doesn't end, or its end isn't known.
+	End time.Time
+	// URL is a web page showing the schedule, if the source has one.
+	URL string
+}
+
+// openIncident is an incident someone is working on.
+type openIncident struct {
+	Number uint
+	Title  string
+	URL    string
+}
+
+// shiftLookup returns the shifts on schedules that start between from and
+// until. A nil or empty list means every schedule configured on the sources.
+type shiftLookup func(ctx context.Context, schedules []string, from time.Time, until time.Time) ([]onCallShift, error)
+
+// onCallResolver answers on-call lookups for the sinks, asking the source
+// that owns each schedule only once per run. It's safe for concurrent use.
+type onCallResolver struct {
+	sources []namedSource
+	sec     deputizeSecrets
+
+	mu    sync.Mutex
+	cache map[onCallCacheKey]*onCallCacheEntry
+	// every lookup made, for the run result
+	results []sourceResult
+}
+
+// onCallCacheKey is a schedule looked up over a window. Each window is cached
+// separately, so sinks that want just now never see a widened answer.
+type onCallCacheKey struct {
+	source   string
+	schedule string
+	window   onCallWindow
+}
+
+// onCallCacheEntry holds the result of looking up one schedule. Its mutex is
+// held during the lookup so concurrent sinks wait for it rather than asking
+// the source again. Failed lookups aren't kept, so a later sink can retry.
+type onCallCacheEntry struct {
+	mu     sync.Mutex
+	done   bool
+	emails []string
+}
+
+func newOnCallResolver(sources []namedSource, sec deputizeSecrets) *onCallResolver {
+	return &onCallResolver{sources: sources, sec: sec, cache: map[onCallCacheKey]*onCallCacheEntry{}}
+}
+
+// resolve returns the combined on-call emails for schedules over window.
+func (r *onCallResolver) resolve(ctx context.Context, schedules []string, window onCallWindow) ([]string, error) {
+	wanted, err := r.wanted(schedules)
+	if err != nil {
+		return nil, err
+	}
+
+	var oncallEmails []string
+	for _, w := range wanted {
+		emails, err := r.lookupSchedule(ctx, w.src, w.schedule, window)
+		if err != nil {
+			return nil, err
+		}
+		oncallEmails = append(oncallEmails, emails...)
+	}
+	return removeDuplicates(oncallEmails), nil
+}
+
+// resolveEach is resolve that carries on past schedules that fail, so one
+// broken schedule doesn't hide the rest. It returns the combined emails from
+// the schedules that worked, and an error for each that didn't.
+func (r *onCallResolver) resolveEach(ctx context.Context, schedules []string, window onCallWindow) ([]string, []string) {
+	wanted, err := r.wanted(schedules)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+
+	var oncallEmails []string
+	var errs []string
+	for _, w := range wanted {
+		emails, err := r.lookupSchedule(ctx, w.src, w.schedule, window)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("schedule %s: %s", w.schedule, err))
+			continue
+		}
+		oncallEmails = append(oncallEmails, emails...)
+	}
+	return removeDuplicates(oncallEmails), errs
+}
+
+// onCallAt returns the combined on-call emails for schedules at a time in the
+// past. Like shifts, these aren't cached.
+func (r *onCallResolver) onCallAt(ctx context.Context, schedules []string, at time.Time) ([]string, error) {
+	wanted, err := r.wanted(schedules)
+	if err != nil {
+		return nil, err
+	}
+
+	var oncallEmails []string
+	for _, w := range wanted {
+		src, ok := w.src.Source.(historySource)
+		if !ok {
+			return nil, fmt.Errorf("%s source can't look up who was on call in the past", w.src.Name)
+		}
+		emails, err := src.OnCallAt(ctx, r.sec, w.schedule, at)
+		if err != nil {
+			return nil, fmt.Errorf("%s source: %s", w.src.Name, err)
+		}
+		oncallEmails = append(oncallEmails, emails...)
+	}
+	return removeDuplicates(oncallEmails), nil
+}
+
+// shifts looks up upcoming shifts for schedules. Unlike who's on call now,
+// they aren't cached.
+func (r *onCallResolver) shifts(ctx context.Context, schedules []string, from time.Time, until time.Time) ([]onCallShift, error) {
+	wanted, err := r.wanted(schedules)
+	if err != nil {
+		return nil, err
+	}
+
+	var shifts []onCallShift
+	for _, w := range wanted {
+		src, ok := w.src.Source.(shiftSource)
+		if !ok {
+			return nil, fmt.Errorf("%s source can't look up upcoming shifts", w.src.Name)
+		}
+		s, err := src.Shifts(ctx, r.sec, w.schedule, from, until)
+		if err != nil {
+			return nil, fmt.Errorf("%s source: %s", w.src.Name, err)
+		}
+		shifts = append(shifts, s...)
+	}
+	return shifts, nil
+}
+
+// scheduleNames returns the schedules looked up for schedules; an empty list
+// means every schedule configured on the sources.
+func (r *onCallResolver) scheduleNames(schedules []string) ([]string, error) {
+	wanted, err := r.wanted(schedules)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, w := range wanted {
+		names = append(names, w.schedule)
+	}
+	return removeDuplicates(names), nil
+}
+
+// openIncidents asks every source that can about the incidents assigned to
+// email. Sources that fail are logged and skipped, as incidents are only
+// ever informational.
+func (r *onCallResolver) openIncidents(ctx context.Context, email string) ([]openIncident, error) {
+	var incidents []openIncident
+	for _, src := range r.sources {
+		is, ok := src.Source.(incidentSource)
+		if !ok {
+			continue
+		}
+		found, err := is.OpenIncidents(ctx, r.sec, email)
+		if err != nil {
+			log.Printf("Warning: %s source couldn't list incidents for %s: %s\n", src.Name, email, err)
+			continue
+		}
+		incidents = append(incidents, found...)
+	}
+	return incidents, nil
+}
+
+// sourceSchedule is a schedule along with the source it's configured on.
+type sourceSchedule struct {
+	src      namedSource
+	schedule string
+}
+
+// wanted works out which source to ask about each schedule. An empty list
+// means every schedule configured on the sources.
+func (r *onCallResolver) wanted(schedules []string) ([]sourceSchedule, error) {
+	var wanted []sourceSchedule
+	if len(schedules) == 0 {
+		for _, src := range r.sources {
+			for _, sch := range src.Schedules() {
+				wanted = append(wanted, sourceSchedule{src, sch})
+			}
+		}
+		return wanted, nil
+	}
+	for _, sch := range schedules {
+		src, err := r.owner(sch)
+		if err != nil {
+			return nil, err
+		}
+		wanted = append(wanted, sourceSchedule{src, sch})
+	}
+	return wanted, nil
+}
+
+// lookupSchedule returns who's on call for one schedule over window, from the
+// cache if it's already been looked up.
+func (r *onCallResolver) lookupSchedule(ctx context.Context, src namedSource, schedule string, window onCallWindow) ([]string, error) {
+	key := onCallCacheKey{source: src.Name, schedule: schedule, window: window}
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	if !ok {
+		entry = &onCallCacheEntry{}
+		r.cache[key] = entry
+	}
+	r.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.done {
+		return entry.emails, nil
+	}
+
+	start := time.Now()
+	var emails []string
+	var err error
+	if window == (onCallWindow{}) {
+		emails, err = src.OnCall(ctx, r.sec, schedule)
+	} else if ws, ok := src.Source.(windowSource); ok {
+		emails, err = ws.OnCallWindow(ctx, r.sec, schedule, window)
+	} else {
+		err = fmt.Errorf("can't look up who's on call with a LeadTime or GracePeriod")
+	}
+	res := sourceResult{
+		Source:     src.Name,
+		Schedule:   schedule,
+		Users:      emails,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if window.LeadTime != 0 {
+		res.LeadTime = window.LeadTime.String()
+	}
+	if window.GracePeriod != 0 {
+		res.GracePeriod = window.GracePeriod.String()
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	r.mu.Lock()
+	r.results = append(r.results, res)
+	r.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("%s source: %s", src.Name, err)
+	}
+
+	log.Printf("%s schedule %s On-Call Users: %s\n", src.Name, schedule, strings.Join(emails, ", "))
+	entry.emails = emails
+	entry.done = true
+	return emails, nil
+}
+
+// sourceResults returns every lookup made so far.
+func (r *onCallResolver) sourceResults() []sourceResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]sourceResult(nil), r.results...)
+}
+
+// owner finds the source a schedule belongs to: the one that lists it in its
+// config, or the only source if there's just one.
+func (r *onCallResolver) owner(schedule string) (namedSource, error) {
+	for _, src := range r.sources {
+		if contains(src.Schedules(), schedule) {
+			return src, nil
+		}
+	}
+	if len(r.sources) == 1 {
+		return r.sources[0], nil
+	}
+	return namedSource{}, fmt.Errorf("schedule %s isn't configured on any source", schedule)
+}
@@ -0,0 +1,216 @@
+// oncall_test.go - tests for the on-call lookups
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSource is a Source with a fixed rota.
+type fakeSource struct {
+	// oncall maps schedules to who's on call for them
+	oncall map[string][]string
+	// schedules are the configured schedules
+	schedules []string
+
+	mu sync.Mutex
+	// lookups counts the lookups made for each schedule
+	lookups map[string]int
+}
+
+func (s *fakeSource) Validate() []string  { return nil }
+func (s *fakeSource) Secrets() []string   { return nil }
+func (s *fakeSource) Schedules() []string { return s.schedules }
+
+func (s *fakeSource) OnCall(ctx context.Context, sec deputizeSecrets, schedule string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lookups == nil {
+		s.lookups = map[string]int{}
+	}
+	s.lookups[schedule]++
+	emails, ok := s.oncall[schedule]
+	if !ok {
+		return nil, fmt.Errorf("no schedule %s", schedule)
+	}
+	return emails, nil
+}
+
+// windowFakeSource is a fakeSource that can also look over a window, adding
+// upcoming people when there's a LeadTime.
+type windowFakeSource struct {
+	*fakeSource
+	upcoming map[string][]string
+}
+
+func (s *windowFakeSource) OnCallWindow(ctx context.Context, sec deputizeSecrets, schedule string, window onCallWindow) ([]string, error) {
+	emails, err := s.OnCall(ctx, sec, schedule)
+	if err != nil || window.LeadTime == 0 {
+		return emails, err
+	}
+	return append(emails, s.upcoming[schedule]...), nil
+}
+
+func TestOnCallResolver(t *testing.T) {
+	pd := &fakeSource{
+		schedules: []string{"Ops", "DBA"},
+		oncall:    map[string][]string{"Ops": {"alice@example.com"}, "DBA": {"bob@example.com", "alice@example.com"}, "Other": {"carol@example.com"}},
+	}
+	og := &fakeSource{
+		schedules: []string{"Web"},
+		oncall:    map[string][]string{"Web": {"dave@example.com"}},
+	}
+	tests := []struct {
+		name      string
+		sources   []namedSource
+		schedules []string
+		want      []string
+		wantErr   bool
+	}{
+		{"every schedule", []namedSource{{"PagerDuty", pd}, {"Opsgenie", og}}, nil, []string{"alice@example.com", "bob@example.com", "dave@example.com"}, false},
+		{"picked schedules", []namedSource{{"PagerDuty", pd}, {"Opsgenie", og}}, []string{"Web", "Ops"}, []string{"dave@example.com", "alice@example.com"}, false},
+		{"unconfigured schedule on the only source", []namedSource{{"PagerDuty", pd}}, []string{"Other"}, []string{"carol@example.com"}, false},
+		{"unconfigured schedule with several sources", []namedSource{{"PagerDuty", pd}, {"Opsgenie", og}}, []string{"Other"}, nil, true},
+		{"source error", []namedSource{{"PagerDuty", pd}}, []string{"Nope"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newOnCallResolver(tt.sources, deputizeSecrets{})
+			got, err := r.resolve(context.Background(), tt.schedules, onCallWindow{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnCallResolverCaches(t *testing.T) {
+	src := &fakeSource{schedules: []string{"Ops"}, oncall: map[string][]string{"Ops": {"alice@example.com"}}}
+	r := newOnCallResolver([]namedSource{{"PagerDuty", src}}, deputizeSecrets{})
+	for i := 0; i < 3; i++ {
+		if _, err := r.resolve(context.Background(), []string{"Ops"}, onCallWindow{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.resolve(context.Background(), nil, onCallWindow{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := src.lookups["Ops"]; got != 1 {
+		t.Errorf("Ops looked up %d times, want 1", got)
+	}
+}
+
+func TestOnCallResolverResults(t *testing.T) {
+	src := &fakeSource{schedules: []string{"Ops"}, oncall: map[string][]string{"Ops": {"alice@example.com"}}}
+	r := newOnCallResolver([]namedSource{{"PagerDuty", src}}, deputizeSecrets{})
+	r.resolve(context.Background(), []string{"Ops"}, onCallWindow{})
+	r.resolve(context.Background(), []string{"Ops"}, onCallWindow{})
+	r.resolve(context.Background(), []string{"Nope"}, onCallWindow{})
+	if len(r.results) != 2 {
+		t.Fatalf("got %d results, want one for each schedule looked up: %+v", len(r.results), r.results)
+	}
+	if got := r.results[0]; got.Source != "PagerDuty" || got.Schedule != "Ops" || !reflect.DeepEqual(got.Users, []string{"alice@example.com"}) || got.Error != "" {
+		t.Errorf("Ops result = %+v", got)
+	}
+	if got := r.results[1]; got.Schedule != "Nope" || got.Error == "" {
+		t.Errorf("Nope result = %+v, want an error", got)
+	}
+}
+
+func TestOnCallResolverConcurrent(t *testing.T) {
+	src := &fakeSource{schedules: []string{"Ops"}, oncall: map[string][]string{"Ops": {"alice@example.com"}}}
+	r := newOnCallResolver([]namedSource{{"PagerDuty", src}}, deputizeSecrets{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.resolve(context.Background(), []string{"Ops"}, onCallWindow{})
+		}()
+	}
+	wg.Wait()
+	if got := src.lookups["Ops"]; got != 1 {
+		t.Errorf("Ops looked up %d times by concurrent sinks, want 1", got)
+	}
+}
+
+func TestOnCallResolverWindow(t *testing.T) {
+	src := &windowFakeSource{
+		fakeSource: &fakeSource{schedules: []string{"Ops"}, oncall: map[string][]string{"Ops": {"alice@example.com"}}},
+		upcoming:   map[string][]string{"Ops": {"bob@example.com"}},
+	}
+	r := newOnCallResolver([]namedSource{{"PagerDuty", src}}, deputizeSecrets{})
+	lead := onCallWindow{LeadTime: 15 * time.Minute}
+	got, err := r.resolve(context.Background(), nil, lead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice@example.com", "bob@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with LeadTime got %q, want %q", got, want)
+	}
+	// Windows are cached apart, so sinks that want just now aren't widened
+	got, err = r.resolve(context.Background(), nil, onCallWindow{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without a window got %q, want %q", got, want)
+	}
+	if res := r.results[0]; res.LeadTime != "15m0s" {
+		t.Errorf("result LeadTime = %q, want 15m0s", res.LeadTime)
+	}
+
+	// A source that can only say who's on call now can't do a window
+	plain := newOnCallResolver([]namedSource{{"Opsgenie", src.fakeSource}}, deputizeSecrets{})
+	if _, err := plain.resolve(context.Background(), nil, lead); err == nil {
+		t.Error("resolve() with a LeadTime on a source without windows succeeded, want an error")
+	}
+}
+
+func TestOnCallResolverOnCallAt(t *testing.T) {
+	src := &windowFakeSource{fakeSource: &fakeSource{schedules: []string{"Ops"}, oncall: map[string][]string{"Ops": {"alice@example.com"}}}}
+	r := newOnCallResolver([]namedSource{{"PagerDuty", src}}, deputizeSecrets{})
+	if _, err := r.onCallAt(context.Background(), nil, time.Now().Add(-time.Hour)); err == nil {
+		t.Error("onCallAt() on a source without history succeeded, want an error")
+	}
+}
+
+func TestOnCallResolverResolveEach(t *testing.T) {
+	src := &fakeSource{
+		schedules: []string{"Ops", "Broken", "DBA"},
+		oncall:    map[string][]string{"Ops": {"alice@example.com"}, "DBA": {"bob@example.com"}},
+	}
+	r := newOnCallResolver([]namedSource{{"PagerDuty", src}}, deputizeSecrets{})
+	got, errs := r.resolveEach(context.Background(), nil, onCallWindow{})
+	if want := []string{"alice@example.com", "bob@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resolveEach() = %q, want %q from the schedules that worked", got, want)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("got errors %q, want one for Broken", errs)
+	}
+	if len(r.results) != 3 || r.results[1].Schedule != "Broken" || r.results[1].Error == "" {
+		t.Errorf("results = %+v, want Broken's failure recorded", r.results)
+	}
+
+	// Sinks that need the broken schedule still fail when they ask for it,
+	// and the others get their answer from the cache
+	if _, err := r.resolve(context.Background(), []string{"Broken"}, onCallWindow{}); err == nil {
+		t.Error("resolve() of a broken schedule succeeded, want an error")
+	}
+	if _, err := r.resolve(context.Background(), []string{"Ops"}, onCallWindow{}); err != nil {
+		t.Errorf("resolve() of a working schedule failed: %s", err)
+	}
+	if src.lookups["Ops"] != 1 {
+		t.Errorf("Ops looked up %d times, want 1", src.lookups["Ops"])
+	}
+}
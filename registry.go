@@ -0,0 +1,306 @@
+// registry.go - source and sink registration
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Source is somewhere we can find out who is on call.
+type Source interface {
+	// Validate checks the source configuration, filling in defaults, and
+	// returns a description of each problem found.
+	Validate() []string
+	// Secrets returns the deputizeSecrets keys the source needs to run.
+	Secrets() []string
+	// Schedules returns the schedules in the source config; these are what
+	// sinks get when they don't pick schedules of their own.
+	Schedules() []string
+	// OnCall returns the emails of the people on call for a schedule.
+	OnCall(ctx context.Context, sec deputizeSecrets, schedule string) ([]string, error)
+}
+
+// shiftSource is implemented by sources that can say when people's shifts
+// start and end, not just who's on call now.
+type shiftSource interface {
+	// Shifts returns the shifts on a schedule that start between from and
+	// until.
+	Shifts(ctx context.Context, sec deputizeSecrets, schedule string, from time.Time, until time.Time) ([]onCallShift, error)
+}
+
+// windowSource is implemented by sources that can say who's on call over a
+// window around now, not just at this moment.
+type windowSource interface {
+	// OnCallWindow returns the emails of the people on call for a schedule at
+	// any point in window.
+	OnCallWindow(ctx context.Context, sec deputizeSecrets, schedule string, window onCallWindow) ([]string, error)
+}
+
+// historySource is implemented by sources that can say who was on call at a
+// time in the past.
+type historySource interface {
+	// OnCallAt returns the emails of the people on call for a schedule at a
+	// given time.
+	OnCallAt(ctx context.Context, sec deputizeSecrets, schedule string, at time.Time) ([]string, error)
+}
+
+// incidentSource is implemented by sources that can list the incidents
+// someone is working on.
+type incidentSource interface {
+	// OpenIncidents returns the unresolved incidents assigned to the user
+	// with the given email.
+	OpenIncidents(ctx context.Context, sec deputizeSecrets, email string) ([]openIncident, error)
+}
+
+// Sink is somewhere we push on-call information to.
+type Sink interface {
+	// Validate checks the sink configuration, filling in defaults, and
+	// returns a description of each problem found.
+	Validate() []string
+	// Secrets returns the deputizeSecrets keys the sink needs to run.
+	Secrets() []string
+	// Update brings the sink in line with who's on call for the schedules it
+	// is configured with, returning the changes it made. With run.dryRun set,
+	// it returns the changes it would have made without making them.
+	Update(ctx context.Context, run *sinkRun) ([]sinkChange, error)
+}
+
+// sinkRun is what a sink is handed for each run.
+type sinkRun struct {
+	sec    deputizeSecrets
+	lookup onCallLookup
+	// window is how far around now the sink counts people as on call
+	window onCallWindow
+	// oncallAt returns who was on call for schedules at a time in the past
+	oncallAt pastLookup
+	shifts   shiftLookup
+	// schedules returns the names of the schedules a sink asking for
+	// schedules gets, expanding an empty list
+	schedules func(schedules []string) ([]string, error)
+	// incidents returns the open incidents assigned to an on-call email
+	incidents func(ctx context.Context, email string) ([]openIncident, error)
+	dryRun    bool
+	clients   *clientCache
+	// what to do about on-call users the sink can't find
+	unresolvedPolicy unresolvedPolicy
+	// who on-call users are in each sink, consulted before looking them up
+	// by email
+	identities identityMap
+
+	// on-call emails the sink couldn't find a user for
+	unresolved []string
+}
+
+// oncall returns the emails of the people on call for schedules, over the
+// sink's window.
+func (run *sinkRun) oncall(ctx context.Context, schedules []string) ([]string, error) {
+	return run.lookup(ctx, schedules, run.window)
+}
+
+// unresolvedUser records that the sink couldn't find a user for email, and
+// applies the sink's unresolvedPolicy. It returns the users to use in their
+// place, if any, or an error if the sink should fail.
+func (run *sinkRun) unresolvedUser(email string) ([]string, error) {
+	run.unresolved = append(run.unresolved, email)
+	switch run.unresolvedPolicy.Action {
+	case unresolvedFail:
+		return nil, fmt.Errorf("no user found for %s", email)
+	case unresolvedFallback:
+		log.Printf("Warning: no user found for %s, using fallback %s\n", email, strings.Join(run.unresolvedPolicy.Fallback, ", "))
+		return run.unresolvedPolicy.Fallback, nil
+	}
+	log.Printf("Warning: no user found for %s, skipping\n", email)
+	return nil, nil
+}
+
+// secretLoader is implemented by modules that need to fetch secrets of their
+// own, beyond what's stored in the main deputize secret.
+type secretLoader interface {
+	LoadSecrets(ctx context.Context, provider SecretProvider, sec deputizeSecrets) error
+}
+
+// sourceFactory returns an empty Source, ready to have its JSON
+// configuration unmarshalled into it.
+type sourceFactory func() Source
+
+// sinkFactory returns an empty Sink, ready to have its JSON configuration
+// unmarshalled into it.
+type sinkFactory func() Sink
+
+var (
+	sourceFactories = map[string]sourceFactory{}
+	sinkFactories   = map[string]sinkFactory{}
+)
+
+// registerSource makes a source available under name in the Source section
+// of the config. It's meant to be called from the init function of a mod_ file.
+func registerSource(name string, f sourceFactory) {
+	key := strings.ToLower(name)
+	if _, dup := sourceFactories[key]; dup {
+		panic(fmt.Sprintf("source %s registered twice", name))
+	}
+	sourceFactories[key] = f
+}
+
+// registerSink makes a sink available under name in the Sinks section of the
+// config. It's meant to be called from the init function of a mod_ file.
+func registerSink(name string, f sinkFactory) {
+	key := strings.ToLower(name)
+	if _, dup := sinkFactories[key]; dup {
+		panic(fmt.Sprintf("sink %s registered twice", name))
+	}
+	sinkFactories[key] = f
+}
+
+// namedSource is a configured source along with the name it was configured
+// under.
+type namedSource struct {
+	Name string
+	Source
+}
+
+// namedSink is a configured sink along with the name it was configured under.
+type namedSink struct {
+	Name string
+	// Critical sinks fail the whole run when they fail.
+	Critical bool
+	// Unresolved is what the sink does about users it can't find.
+	Unresolved unresolvedPolicy
+	// Window is how far around now the sink counts people as on call.
+	Window onCallWindow
+	Sink
+}
+
+// moduleFlags are the options every module config carries, whatever else it
+// holds.
+type moduleFlags struct {
+	Enabled bool
+	// Critical only applies to sinks, and defaults to true
+	Critical *bool
+	// UnresolvedUsers only applies to sinks, and defaults to the top level
+	// UnresolvedUsers
+	UnresolvedUsers unresolvedPolicy
+	// LeadTime only applies to sinks. It adds people going on call within
+	// this long, as a Go duration ("15m"), so they have access by the time
+	// their shift starts.
+	LeadTime string
+	// GracePeriod only applies to sinks. It keeps people who went off call
+	// within this long, as a Go duration, so they can finish off an incident.
+	GracePeriod string
+}
+
+// peekModuleFlags reads the moduleFlags out of a module's config.
+func peekModuleFlags(raw json.RawMessage) (moduleFlags, error) {
+	var m moduleFlags
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return moduleFlags{}, err
+	}
+	if m.Critical == nil {
+		critical := true
+		m.Critical = &critical
+	}
+	return m, nil
+}
+
+// window parses LeadTime and GracePeriod.
+func (m moduleFlags) window() (onCallWindow, []string) {
+	var window onCallWindow
+	var configErrors []string
+	if m.LeadTime != "" {
+		d, err := time.ParseDuration(m.LeadTime)
+		if err != nil || d < 0 {
+			configErrors = append(configErrors, "LeadTime is invalid")
+		}
+		window.LeadTime = d
+	}
+	if m.GracePeriod != "" {
+		d, err := time.ParseDuration(m.GracePeriod)
+		if err != nil || d < 0 {
+			configErrors = append(configErrors, "GracePeriod is invalid")
+		}
+		window.GracePeriod = d
+	}
+	return window, configErrors
+}
+
+// loadSources builds every enabled source in the config. Names are matched
+// case insensitively, so existing configs keep working.
+func loadSources(cfg map[string]json.RawMessage) ([]namedSource, []string) {
+	var loaded []namedSource
+	var configErrors []string
+	for _, name := range sortedKeys(cfg) {
+		factory, ok := sourceFactories[strings.ToLower(name)]
+		if !ok {
+			configErrors = append(configErrors, fmt.Sprintf("Source: unknown source %s", name))
+			continue
+		}
+		flags, err := peekModuleFlags(cfg[name])
+		if err != nil {
+			configErrors = append(configErrors, fmt.Sprintf("%s Source: unable to parse config: %s", name, err))
+			continue
+		}
+		if !flags.Enabled {
+			continue
+		}
+		src := factory()
+		if err := json.Unmarshal(cfg[name], src); err != nil {
+			configErrors = append(configErrors, fmt.Sprintf("%s Source: unable to parse config: %s", name, err))
+			continue
+		}
+		loaded = append(loaded, namedSource{Name: name, Source: src})
+	}
+	return loaded, configErrors
+}
+
+// loadSinks builds every enabled sink in the config. Names are matched case
+// insensitively, so existing configs keep working.
+func loadSinks(cfg map[string]json.RawMessage) ([]namedSink, []string) {
+	var loaded []namedSink
+	var configErrors []string
+	for _, name := range sortedKeys(cfg) {
+		factory, ok := sinkFactories[strings.ToLower(name)]
+		if !ok {
+			configErrors = append(configErrors, fmt.Sprintf("Sinks: unknown sink %s", name))
+			continue
+		}
+		flags, err := peekModuleFlags(cfg[name])
+		if err != nil {
+			configErrors = append(configErrors, fmt.Sprintf("%s Sink: unable to parse config: %s", name, err))
+			continue
+		}
+		if !flags.Enabled {
+			continue
+		}
+		sink := factory()
+		if err := json.Unmarshal(cfg[name], sink); err != nil {
+			configErrors = append(configErrors, fmt.Sprintf("%s Sink: unable to parse config: %s", name, err))
+			continue
+		}
+		for _, e := range flags.UnresolvedUsers.validate() {
+			configErrors = append(configErrors, fmt.Sprintf("%s Sink: %s", name, e))
+		}
+		window, windowErrors := flags.window()
+		for _, e := range windowErrors {
+			configErrors = append(configErrors, fmt.Sprintf("%s Sink: %s", name, e))
+		}
+		loaded = append(loaded, namedSink{Name: name, Critical: *flags.Critical, Unresolved: flags.UnresolvedUsers, Window: window, Sink: sink})
+	}
+	return loaded, configErrors
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
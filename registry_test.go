@@ -0,0 +1,95 @@
+// registry_test.go - tests for loading modules
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPeekModuleFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		enabled  bool
+		critical bool
+		wantErr  bool
+	}{
+		{"defaults", `{}`, false, true, false},
+		{"enabled", `{"Enabled": true}`, true, true, false},
+		{"not critical", `{"Enabled": true, "Critical": false}`, true, false, false},
+		{"bad json", `{"Enabled": "yes"}`, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, err := peekModuleFlags(json.RawMessage(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if flags.Enabled != tt.enabled || *flags.Critical != tt.critical {
+				t.Errorf("Enabled %v Critical %v, want %v %v", flags.Enabled, *flags.Critical, tt.enabled, tt.critical)
+			}
+		})
+	}
+}
+
+func TestModuleFlagsWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   moduleFlags
+		want    onCallWindow
+		wantErr bool
+	}{
+		{"now", moduleFlags{}, onCallWindow{}, false},
+		{"lead time and grace period", moduleFlags{LeadTime: "15m", GracePeriod: "1h"}, onCallWindow{LeadTime: 15 * time.Minute, GracePeriod: time.Hour}, false},
+		{"bad lead time", moduleFlags{LeadTime: "soon"}, onCallWindow{}, true},
+		{"negative grace period", moduleFlags{GracePeriod: "-1h"}, onCallWindow{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, errs := tt.flags.window()
+			if (len(errs) > 0) != tt.wantErr {
+				t.Fatalf("window() = %q, wantErr %v", errs, tt.wantErr)
+			}
+			if !tt.wantErr && window != tt.want {
+				t.Errorf("window() = %+v, want %+v", window, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnresolvedUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   unresolvedPolicy
+		fallback []string
+		wantErr  bool
+	}{
+		{"default skips", unresolvedPolicy{}, nil, false},
+		{"skip", unresolvedPolicy{Action: unresolvedSkip}, nil, false},
+		{"fail", unresolvedPolicy{Action: unresolvedFail}, nil, true},
+		{"fallback", unresolvedPolicy{Action: unresolvedFallback, Fallback: []string{"oncall-bot"}}, []string{"oncall-bot"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := &sinkRun{unresolvedPolicy: tt.policy}
+			fallback, err := run.unresolvedUser("bob@example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(fallback, tt.fallback) {
+				t.Errorf("fallback = %q, want %q", fallback, tt.fallback)
+			}
+			if !reflect.DeepEqual(run.unresolved, []string{"bob@example.com"}) {
+				t.Errorf("unresolved = %q, want the user recorded whatever the policy", run.unresolved)
+			}
+		})
+	}
+}
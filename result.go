@@ -0,0 +1,68 @@
+// result.go - what a run of deputize reports back
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"time"
+)
+
+// Sink statuses reported in sinkResult.
+const (
+	sinkUnchanged = "unchanged"
+	sinkUpdated   = "updated"
+	sinkPlanned   = "planned" // a dry run found changes to make
+	sinkFailed    = "failed"
+)
+
+// deputizeResult is what a run of deputize hands back to its caller.
+type deputizeResult struct {
+	DryRun     bool
+	Started    time.Time
+	DurationMs int64
+	// OnCall is everyone on call across the source schedules.
+	OnCall  []string
+	Sources []sourceResult
+	Sinks   []sinkResult
+	// Unresolved is every on-call email a sink couldn't find a user for.
+	Unresolved []string `json:",omitempty"`
+	Error      string   `json:",omitempty"`
+}
+
+// sourceResult is the outcome of looking up one schedule on a source.
+type sourceResult struct {
+	Source   string
+	Schedule string
+	Users    []string
+	// LeadTime and GracePeriod are set when the lookup was widened for a
+	// sink's window.
+	LeadTime    string `json:",omitempty"`
+	GracePeriod string `json:",omitempty"`
+	DurationMs  int64
+	Error       string `json:",omitempty"`
+}
+
+// sinkResult is the outcome of running one sink.
+type sinkResult struct {
+	Pipeline string `json:",omitempty"`
+	Sink     string
+	Critical bool
+	Status   string
+	// Changes the sink made, or would make in a dry run.
+	Changes []sinkChange `json:",omitempty"`
+	// Unresolved lists on-call emails the sink couldn't find a user for.
+	Unresolved []string `json:",omitempty"`
+	DurationMs int64
+	Error      string `json:",omitempty"`
+}
+
+// sinkChange describes what a sink changed, or would change in a dry run, on
+// one of its targets (an LDAP group, a GitLab group, a Slack channel).
+type sinkChange struct {
+	Target  string
+	Add     []string `json:",omitempty"`
+	Remove  []string `json:",omitempty"`
+	Topic   string   `json:",omitempty"`
+	Message string   `json:",omitempty"`
+}
@@ -0,0 +1,266 @@
+// secrets.go - secret storage backends
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// SecretProvider is somewhere deputize can read its secrets from.
+type SecretProvider interface {
+	// Secrets returns the key/value pairs stored at path; this is how
+	// deputizeSecrets gets populated.
+	Secrets(ctx context.Context, path string) (deputizeSecrets, error)
+	// Secret returns a single value stored at path, such as the PagerDuty
+	// OAuth token kept up to date by pdrotator.
+	Secret(ctx context.Context, path string) (string, error)
+}
+
+// Names for the SecretBackend config option.
+const (
+	secretBackendSecretsManager = "SecretsManager"
+	secretBackendParameterStore = "ParameterStore"
+	secretBackendVault          = "Vault"
+	secretBackendEnv            = "Env"
+	secretBackendFile           = "File"
+)
+
+var secretBackends = []string{
+	secretBackendSecretsManager,
+	secretBackendParameterStore,
+	secretBackendVault,
+	secretBackendEnv,
+	secretBackendFile,
+}
+
+type deputizeVaultConfig struct {
+	// Address of the Vault server; defaults to VAULT_ADDR.
+	Address string
+	// Mount is where the KV v2 secrets engine is mounted; defaults to "secret".
+	Mount string
+	// Namespace is the Vault Enterprise namespace, if any; defaults to VAULT_NAMESPACE.
+	Namespace string
+}
+
+// newSecretProvider sets up the backend named by cfg.SecretBackend.
+func newSecretProvider(ctx context.Context, cfg *deputizeConfig) (SecretProvider, error) {
+	switch cfg.SecretBackend {
+	case secretBackendSecretsManager, secretBackendParameterStore:
+		svcCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.SecretRegion))
+		if err != nil {
+			return nil, fmt.Errorf("could not initialize aws svc cfg: %s", err)
+		}
+		if cfg.SecretBackend == secretBackendParameterStore {
+			return &parameterStoreProvider{svc: ssm.NewFromConfig(svcCfg)}, nil
+		}
+		return &secretsManagerProvider{svc: secretsmanager.NewFromConfig(svcCfg)}, nil
+	case secretBackendVault:
+		token := os.Getenv("VAULT_TOKEN")
+		if token == "" {
+			return nil, fmt.Errorf("vault secret backend selected, but VAULT_TOKEN is not set")
+		}
+		return &vaultProvider{
+			address:   strings.TrimSuffix(cfg.Vault.Address, "/"),
+			mount:     strings.Trim(cfg.Vault.Mount, "/"),
+			namespace: cfg.Vault.Namespace,
+			token:     token,
+			client:    &http.Client{Timeout: httpTimeout},
+		}, nil
+	case secretBackendEnv:
+		return envProvider{}, nil
+	case secretBackendFile:
+		return fileProvider{}, nil
+	}
+	return nil, fmt.Errorf("unknown secret backend %s", cfg.SecretBackend)
+}
+
+// secretsManagerProvider reads secrets from AWS Secrets Manager. Secrets are
+// stored as a JSON object.
+type secretsManagerProvider struct {
+	svc *secretsmanager.Client
+}
+
+func (p *secretsManagerProvider) Secret(ctx context.Context, path string) (string, error) {
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(path),
+	}
+	result, err := p.svc.GetSecretValue(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("could not get secret: %s", err)
+	}
+	return aws.ToString(result.SecretString), nil
+}
+
+func (p *secretsManagerProvider) Secrets(ctx context.Context, path string) (deputizeSecrets, error) {
+	value, err := p.Secret(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	sec := deputizeSecrets{}
+	json.Unmarshal([]byte(value), &sec)
+	return sec, nil
+}
+
+// parameterStoreProvider reads secrets from AWS SSM Parameter Store. Each
+// secret is a parameter under the path, named after its key, e.g.
+// /deputize/prod/SlackAuthToken.
+type parameterStoreProvider struct {
+	svc *ssm.Client
+}
+
+func (p *parameterStoreProvider) Secret(ctx context.Context, path string) (string, error) {
+	input := &ssm.GetParameterInput{
+		Name:           aws.String(path),
+		WithDecryption: aws.Bool(true),
+	}
+	result, err := p.svc.GetParameter(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("could not get parameter: %s", err)
+	}
+	return aws.ToString(result.Parameter.Value), nil
+}
+
+func (p *parameterStoreProvider) Secrets(ctx context.Context, secretPath string) (deputizeSecrets, error) {
+	sec := deputizeSecrets{}
+	input := &ssm.GetParametersByPathInput{
+		Path:           aws.String(secretPath),
+		WithDecryption: aws.Bool(true),
+	}
+	paginator := ssm.NewGetParametersByPathPaginator(p.svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not get parameters: %s", err)
+		}
+		for _, param := range page.Parameters {
+			sec[path.Base(aws.ToString(param.Name))] = aws.ToString(param.Value)
+		}
+	}
+	return sec, nil
+}
+
+// vaultProvider reads secrets from a HashiCorp Vault KV v2 secrets engine.
+// Single values are read from the "value" key of the entry at their path.
+type vaultProvider struct {
+	address   string
+	mount     string
+	namespace string
+	token     string
+	client    *http.Client
+}
+
+func (p *vaultProvider) read(ctx context.Context, secretPath string) (map[string]any, error) {
+	url := fmt.Sprintf("%s/v1/%s/data/%s", p.address, p.mount, strings.TrimPrefix(secretPath, "/"))
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build vault request: %s", err)
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to talk to vault: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read vault body: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not get vault secret %s: %s", secretPath, resp.Status)
+	}
+
+	var kv struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &kv); err != nil {
+		return nil, fmt.Errorf("unable to parse json: %s", err)
+	}
+	return kv.Data.Data, nil
+}
+
+func (p *vaultProvider) Secret(ctx context.Context, path string) (string, error) {
+	data, err := p.read(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	value, _ := data["value"].(string)
+	return value, nil
+}
+
+func (p *vaultProvider) Secrets(ctx context.Context, path string) (deputizeSecrets, error) {
+	data, err := p.read(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	sec := deputizeSecrets{}
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			sec[k] = s
+		}
+	}
+	return sec, nil
+}
+
+// envProvider reads secrets from environment variables. The path is a prefix,
+// so with a path of DEPUTIZE_ the SlackAuthToken comes from
+// DEPUTIZE_SlackAuthToken. Single values are read from the variable named by
+// their path.
+type envProvider struct{}
+
+func (envProvider) Secret(ctx context.Context, path string) (string, error) {
+	return os.Getenv(path), nil
+}
+
+func (envProvider) Secrets(ctx context.Context, prefix string) (deputizeSecrets, error) {
+	sec := deputizeSecrets{}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		if key, ok := strings.CutPrefix(k, prefix); ok && key != "" {
+			sec[key] = v
+		}
+	}
+	return sec, nil
+}
+
+// fileProvider reads secrets from local files. Secrets are stored as a JSON
+// object; single values are the contents of their file.
+type fileProvider struct{}
+
+func (fileProvider) Secret(ctx context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read secret file: %s", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (fileProvider) Secrets(ctx context.Context, path string) (deputizeSecrets, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read secret file: %s", err)
+	}
+	sec := deputizeSecrets{}
+	if err := json.Unmarshal(data, &sec); err != nil {
+		return nil, fmt.Errorf("unable to parse secret file %s: %s", path, err)
+	}
+	return sec, nil
+}
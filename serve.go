@@ -0,0 +1,225 @@
+// serve.go - long-running daemon front-end
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+type deputizeServeConfig struct {
+	// Interval between runs, as a Go duration ("5m"). Ignored if Cron is set.
+	Interval string
+	// Cron is a standard five field cron expression to run on.
+	Cron string
+	// Jitter is the most we'll randomly delay each run by, as a Go duration.
+	Jitter string
+	// Listen is the address the health check server listens on.
+	Listen string
+}
+
+// validate checks the serve configuration, returning the run schedule and
+// jitter it describes.
+func (cfg *deputizeServeConfig) validate() (cron.Schedule, time.Duration, error) {
+	var configErrors []string
+	var schedule cron.Schedule
+	var jitter time.Duration
+
+	if cfg.Listen == "" {
+		cfg.Listen = ":8080"
+	}
+	switch {
+	case cfg.Cron != "":
+		s, err := cron.ParseStandard(cfg.Cron)
+		if err != nil {
+			configErrors = append(configErrors, fmt.Sprintf("Serve: Cron is invalid: %s", err))
+		}
+		schedule = s
+	case cfg.Interval != "":
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil || d < time.Second {
+			configErrors = append(configErrors, "Serve: Interval must be a duration of at least 1s")
+		}
+		schedule = cron.Every(d)
+	default:
+		configErrors = append(configErrors, "Serve: one of Interval or Cron must be set")
+	}
+	if cfg.Jitter != "" {
+		d, err := time.ParseDuration(cfg.Jitter)
+		if err != nil || d < 0 {
+			configErrors = append(configErrors, "Serve: Jitter is invalid")
+		}
+		jitter = d
+	}
+
+	if len(configErrors) > 0 {
+		return nil, 0, fmt.Errorf("config validation error(s): %s", buildErrorMsg(configErrors))
+	}
+	return schedule, jitter, nil
+}
+
+// serveStatus tracks how the daemon is doing for the health check endpoints.
+type serveStatus struct {
+	mu          sync.Mutex
+	lastRun     time.Time
+	lastErr     error
+	lastSuccess time.Time
+}
+
+func (s *serveStatus) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRun = time.Now()
+	s.lastErr = err
+	if err == nil {
+		s.lastSuccess = s.lastRun
+	}
+}
+
+// healthz reports that the daemon is up.
+func (s *serveStatus) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz reports ready once a sync has succeeded, and not ready while the
+// most recent sync is failing.
+func (s *serveStatus) readyz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.lastRun.IsZero():
+		http.Error(w, "waiting for first sync", http.StatusServiceUnavailable)
+	case s.lastErr != nil:
+		http.Error(w, fmt.Sprintf("last sync at %s failed: %s", s.lastRun.Format(time.RFC3339), s.lastErr), http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintf(w, "ok, last sync at %s\n", s.lastSuccess.Format(time.RFC3339))
+	}
+}
+
+// hasSlackReminders reports whether any Slack sink in a validated config
+// sends reminders. Each run reminds people whose shifts start within the
+// Window after it, so jittered runs would send some reminders twice and miss
+// others.
+func hasSlackReminders(cfg *deputizeConfig) bool {
+	sinks := append([]namedSink{}, cfg.sinks...)
+	for _, p := range cfg.Pipelines {
+		sinks = append(sinks, p.sinks...)
+	}
+	for _, sink := range sinks {
+		if slack, ok := sink.Sink.(*deputizeSlackConfig); ok && slack.Reminders != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// runTimeout is how long a run starting at now gets: the gap between the
+// next two scheduled runs, which for an Interval is the interval itself.
+func runTimeout(schedule cron.Schedule, now time.Time) time.Duration {
+	next := schedule.Next(now)
+	return schedule.Next(next).Sub(next)
+}
+
+// cliServe reads the config once and syncs on a schedule until it gets
+// SIGTERM or SIGINT. A sync that's in progress is allowed to finish.
+func cliServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	configPath := fs.String("config", "config.json", "path to the deputize JSON config")
+	listen := fs.String("listen", "", "address for the /healthz and /readyz server (overrides Serve.Listen in the config)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfigFile(*configPath)
+	if err != nil {
+		log.Printf("Error: %s\n", err)
+		return 1
+	}
+	if *listen != "" {
+		cfg.Serve.Listen = *listen
+	}
+	schedule, jitter, err := cfg.Serve.validate()
+	if err != nil {
+		log.Printf("Error: %s\n", err)
+		return 1
+	}
+	// Catch config mistakes before we start, rather than on the first run.
+	if err := validateConfig(cfg); err != nil {
+		log.Printf("Error: %s\n", err)
+		return 1
+	}
+	if jitter > 0 && hasSlackReminders(cfg) {
+		log.Printf("Error: Serve: Jitter can't be used with Slack Reminders, which need runs to be evenly spaced\n")
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	status := &serveStatus{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", status.healthz)
+	mux.HandleFunc("/readyz", status.readyz)
+	srv := &http.Server{Addr: cfg.Serve.Listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	// A daemon that can't answer health checks has failed, so the listen
+	// error is kept to exit non-zero with
+	listenErr := make(chan error, 1)
+	go func() {
+		log.Printf("Health checks listening on %s\n", cfg.Serve.Listen)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error: health check server: %s\n", err)
+			listenErr <- err
+			stop()
+		}
+	}()
+
+	for {
+		// Runs get their own context so a shutdown doesn't cut one off halfway
+		// through updating a sink. Each has until the gap between runs to
+		// finish, so a hung source or sink can't hold up the next one.
+		runCtx, cancel := context.WithTimeout(context.Background(), runTimeout(schedule, time.Now()))
+		_, err := runDeputize(runCtx, cfg)
+		cancel()
+		if err != nil {
+			log.Printf("Error: sync failed: %s\n", err)
+		}
+		status.record(err)
+
+		next := schedule.Next(time.Now())
+		if jitter > 0 {
+			next = next.Add(rand.N(jitter))
+		}
+		log.Printf("Next sync at %s\n", next.Format(time.RFC3339))
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Shutting down\n")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				log.Printf("Error: health check server shutdown: %s\n", err)
+			}
+			select {
+			case <-listenErr:
+				return 1
+			default:
+			}
+			return 0
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
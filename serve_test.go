@@ -0,0 +1,54 @@
+// serve_test.go - tests for the daemon front-end
+// Copyright 2024 F5 Inc.
+// Licensed under the BSD 3-clause license; see LICENSE.md for more information.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunTimeout(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 2, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		cfg  deputizeServeConfig
+		want time.Duration
+	}{
+		{name: "interval", cfg: deputizeServeConfig{Interval: "5m"}, want: 5 * time.Minute},
+		{name: "cron", cfg: deputizeServeConfig{Cron: "0 9,17 * * *"}, want: 16 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, _, err := tt.cfg.validate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := runTimeout(schedule, now); got != tt.want {
+				t.Errorf("runTimeout() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasSlackReminders(t *testing.T) {
+	reminders := namedSink{Name: "Slack", Sink: &deputizeSlackConfig{Reminders: &slackReminders{Before: "1h"}}}
+	topics := namedSink{Name: "Slack", Sink: &deputizeSlackConfig{Channels: []slackChannel{{ID: "C0OPS"}}}}
+	tests := []struct {
+		name string
+		cfg  *deputizeConfig
+		want bool
+	}{
+		{name: "none", cfg: &deputizeConfig{sinks: []namedSink{topics}}},
+		{name: "top level", cfg: &deputizeConfig{sinks: []namedSink{topics, reminders}}, want: true},
+		{name: "pipeline", cfg: &deputizeConfig{Pipelines: []deputizePipelineConfig{{Name: "db", sinks: []namedSink{reminders}}}}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasSlackReminders(tt.cfg); got != tt.want {
+				t.Errorf("hasSlackReminders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}